@@ -0,0 +1,107 @@
+package netchan
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRejected is wrapped by the error of a net-chan whose open has been rejected by the
+// Authorizer of a session, see SessionOptions.Authorizer. The net-chan fails on both
+// peers; the session is not affected.
+var ErrRejected = errors.New("netchan: net-chan rejected")
+
+// An OpenRequest describes a net-chan that the peer is opening, see
+// SessionOptions.Authorizer.
+type OpenRequest struct {
+	Session *Session
+	// PeerIdentity is the verified identity of the peer, see Session.PeerIdentity.
+	PeerIdentity string
+	Name         string
+	// PeerSends is true if the peer is opening the net-chan for sending, false if it
+	// is opening it for receiving.
+	PeerSends bool
+	// ElemType is the name of the element type of the channel of the peer.
+	ElemType string
+}
+
+/*
+The Authorizer is consulted when the open message of the peer arrives, whether the
+net-chan is open locally or not. A rejection reuses the close handshake, so that the
+name can be used again afterwards:
+
+- the peer wants to send (initDataMsg): the recvManager records the net-chan as rejected
+  and sends a rejectMsg, by name, to the sender, which cancels the open and closes the
+  net-chan as usual. If the net-chan is open locally, the recvProxy has already sent the
+  initial credit: the local open is canceled with the rejection and the recvProxy sends
+  the rejectMsg, with the id, instead of the cancelMsg.
+
+- the peer wants to receive (initCreditMsg): the sendManager closes the net-chan, with a
+  closeMsg that carries the reason of the rejection in Err. If the net-chan is open
+  locally, the open is canceled and the sendProxy sends the closeMsg.
+
+On either side, the net-chan fails with a rejection error.
+*/
+
+// A rejection is the error of a rejected net-chan.
+type rejection struct {
+	chName, reason string
+	local          bool // rejected by the local Authorizer
+}
+
+func (r *rejection) Error() string {
+	if r.local {
+		return fmt.Sprintf("netchan: net-chan %s rejected: %s", r.chName, r.reason)
+	}
+	return fmt.Sprintf("netchan: net-chan %s rejected by peer: %s", r.chName, r.reason)
+}
+
+func (r *rejection) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// localRejection returns the reason of err if it is a rejection by the local
+// Authorizer.
+func localRejection(err error) (reason string, ok bool) {
+	rej, ok := err.(*rejection)
+	if !ok || !rej.local {
+		return "", false
+	}
+	return rej.reason, true
+}
+
+var errAuthorizeTimeout = errors.New("authorizer timed out")
+
+// authorize asks the Authorizer of the session, if any, whether the peer can open a
+// net-chan. It returns a rejection error if it can not.
+//
+// It is called by the managers, after checking that the open does not violate the
+// protocol, and it blocks them: the Authorizer runs in its own goroutine, and if it does
+// not return within AuthorizeTimeout the open is rejected and its result is discarded.
+// The decision can not be taken asynchronously, because the following messages of the
+// net-chan (such as a close by name) must find it accepted or rejected.
+func (m *Session) authorize(chName string, peerSends bool, elemType string) error {
+	if m.opts.Authorizer == nil {
+		return nil
+	}
+	req := OpenRequest{Session: m, PeerIdentity: m.PeerIdentity(), Name: chName,
+		PeerSends: peerSends, ElemType: elemType}
+	result := make(chan error, 1)
+	go func() {
+		result <- m.opts.Authorizer(req)
+	}()
+	timer := time.NewTimer(m.opts.AuthorizeTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-result:
+	case <-timer.C:
+		err = errAuthorizeTimeout
+	case <-m.Done():
+		err = m.Err()
+	}
+	if err == nil {
+		return nil
+	}
+	return &rejection{chName: chName, reason: err.Error(), local: true}
+}
@@ -0,0 +1,57 @@
+package netchan
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+A net-chan opened with OpenRecvBytes counts its credits in bytes instead of values. The
+initial credit carries the flag ByteCredit and the budget of the receiver; then:
+
+- the receiver charges each batch that it puts in its buffer with the size of the
+  message, header included, as measured by the limitedReader of the decoder, and
+  returns that amount of credit when the recvProxy takes the batch out of the buffer;
+
+- the sender can not know the size of a batch before it is encoded, so it sends a batch
+  whenever its credit is positive and the encoder reports the size of the message, which
+  the sendProxy subtracts from its credit. The sendProxy waits for the size of a batch
+  before sending the next one, so the credit is exceeded by one message at most.
+
+Both peers charge a batch at least minBatchCost bytes, which bounds the number of
+batches in a buffer. The sizes measured by the peers are the same only if the decoder
+reads exactly the bytes of each message from the connection, as gob does; with a codec
+that reads ahead, the credits of the two peers drift apart.
+*/
+
+// minBatchCost is the minimum amount of byte credit charged for a batch.
+const minBatchCost = 64
+
+// batchCost returns the amount of byte credit charged for a batch whose message is size
+// bytes long.
+func batchCost(size int) int {
+	if size < minBatchCost {
+		return minBatchCost
+	}
+	return size
+}
+
+// OpenRecvBytes is like OpenRecvChan, but the buffer of the net-chan is bounded by the
+// encoded size of the values instead of their number: byteBudget is the number of bytes
+// that the peer can send before the user receives them. The buffer can exceed the budget
+// by one message, which is limited by SessionOptions.MsgSizeLimit; each batch counts for
+// at least 64 bytes. This makes the memory used by the buffer predictable when the size
+// of the values varies, for example with slices. ChanStats.Pending counts bytes, on both
+// peers. The peer must support FeatureByteCredits. Like OpenRecv, it can block until the
+// previous net-chan with the same name is closed.
+func (m *Session) OpenRecvBytes(name string, channel interface{}, byteBudget int) (*NetChan,
+	error) {
+	if byteBudget < minBatchCost {
+		return nil, fmtErr("OpenRecvBytes byteBudget must be at least %d", minBatchCost)
+	}
+	if peer := m.Peer(); peer.Version != 0 && peer.Features&FeatureByteCredits == 0 {
+		return nil, fmt.Errorf("%w: the peer does not support byte credits",
+			ErrIncompatiblePeer)
+	}
+	return m.openRecv(context.Background(), name, channel, byteBudget, true)
+}
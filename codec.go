@@ -0,0 +1,87 @@
+package netchan
+
+import (
+	"encoding/gob"
+	"io"
+	"reflect"
+)
+
+// A Codec defines how the messages exchanged by two netchan sessions are serialized.
+// Both peers of a connection must use compatible codecs.
+//
+// Every message is made of a header, optionally followed by a batch. A header is a
+// struct with exported fields only, whose types are integers, strings or byte slices;
+// encoders based on reflection, like gob or JSON, can serialize it as is. A batch is a
+// slice of values sent by the user on a net-chan.
+type Codec interface {
+	// NewEncoder returns an Encoder that writes to w. The session flushes w when
+	// needed, so the encoder should not do its own buffering.
+	NewEncoder(w io.Writer) Encoder
+
+	// NewDecoder returns a Decoder that reads from r.
+	NewDecoder(r io.Reader) Decoder
+}
+
+// An Encoder writes netchan messages to a stream. The methods of an Encoder are never
+// called concurrently.
+type Encoder interface {
+	// EncodeHeader writes a message header. h is a header struct (not a pointer).
+	EncodeHeader(h interface{}) error
+
+	// EncodeBatch writes a batch, batch is a slice.
+	EncodeBatch(batch reflect.Value) error
+}
+
+// A Decoder reads netchan messages from a stream. The methods of a Decoder are never
+// called concurrently.
+type Decoder interface {
+	// DecodeHeader reads a message header and stores it in h, which is a pointer to a
+	// header struct.
+	DecodeHeader(h interface{}) error
+
+	// DecodeBatch reads a batch and returns it as a new value of type t, which is a
+	// slice type. If t is nil, the batch is read and discarded.
+	DecodeBatch(t reflect.Type) (reflect.Value, error)
+}
+
+// GobCodec is the default Codec: it serializes messages with encoding/gob
+// (https://golang.org/pkg/encoding/gob/). Any data transmitted with it must obey gob's
+// laws.
+type GobCodec struct{}
+
+func (GobCodec) NewEncoder(w io.Writer) Encoder {
+	return gobEncoder{gob.NewEncoder(w)}
+}
+
+func (GobCodec) NewDecoder(r io.Reader) Decoder {
+	return gobDecoder{gob.NewDecoder(r)}
+}
+
+type gobEncoder struct {
+	enc *gob.Encoder
+}
+
+func (e gobEncoder) EncodeHeader(h interface{}) error {
+	return e.enc.Encode(h)
+}
+
+func (e gobEncoder) EncodeBatch(batch reflect.Value) error {
+	return e.enc.EncodeValue(batch)
+}
+
+type gobDecoder struct {
+	dec *gob.Decoder
+}
+
+func (d gobDecoder) DecodeHeader(h interface{}) error {
+	return d.dec.Decode(h)
+}
+
+func (d gobDecoder) DecodeBatch(t reflect.Type) (reflect.Value, error) {
+	if t == nil {
+		return reflect.Value{}, d.dec.DecodeValue(reflect.Value{})
+	}
+	batch := reflect.New(t).Elem()
+	err := d.dec.DecodeValue(batch)
+	return batch, err
+}
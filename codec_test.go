@@ -0,0 +1,61 @@
+package netchan_test
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/pinkgopher/netchan"
+)
+
+// jsonCodec serializes netchan messages as a stream of JSON values.
+type jsonCodec struct{}
+
+func (jsonCodec) NewEncoder(w io.Writer) netchan.Encoder {
+	return jsonEncoder{json.NewEncoder(w)}
+}
+
+func (jsonCodec) NewDecoder(r io.Reader) netchan.Decoder {
+	return jsonDecoder{json.NewDecoder(r)}
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e jsonEncoder) EncodeHeader(h interface{}) error {
+	return e.enc.Encode(h)
+}
+
+func (e jsonEncoder) EncodeBatch(batch reflect.Value) error {
+	return e.enc.Encode(batch.Interface())
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d jsonDecoder) DecodeHeader(h interface{}) error {
+	return d.dec.Decode(h)
+}
+
+func (d jsonDecoder) DecodeBatch(t reflect.Type) (reflect.Value, error) {
+	if t == nil {
+		var discard json.RawMessage
+		return reflect.Value{}, d.dec.Decode(&discard)
+	}
+	batch := reflect.New(t)
+	err := d.dec.Decode(batch.Interface())
+	return batch.Elem(), err
+}
+
+func TestCodec(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	intProducer(t, netchan.NewSessionCodec(sideA, jsonCodec{}, 0), "integers", 1000)
+	s := <-intConsumer(t, netchan.NewSessionCodec(sideB, jsonCodec{}, 0), "integers")
+	if len(s) != 1000 {
+		t.Fatalf("expected 1000 integers, got %d", len(s))
+	}
+	checkIntSlice(t, s)
+}
@@ -20,23 +20,46 @@ const (
 	creditMsg
 	initCreditMsg
 	errorMsg
+	cancelMsg
+	closeAckMsg
+	resetMsg
+	pingMsg
+	pongMsg
+	ackMsg
+	rejectMsg
+	connCreditMsg
 
 	lastReservedMsg = 15
 )
 
-// preceedes every message
+// Preceedes every message. The fields that follow the first three are used only by some
+// message types and left empty by the others.
 type header struct {
-	Type   msgType
-	ChId   int
-	ChName string
+	Type       msgType
+	ChId       int
+	ChName     string
+	Credit     int    // creditMsg, initCreditMsg and connCreditMsg
+	ByteCredit bool   // initCreditMsg, if the credits are in bytes (see bytecredit.go)
+	Err        string // errorMsg, cancelMsg, resetMsg, rejectMsg and closeMsg
+	ElemType   string // initDataMsg and initCreditMsg
+	TypeDesc   []byte // initDataMsg and initCreditMsg
+	Dirs       uint8  // initDataMsg and initCreditMsg, see mismatch.go
+	Stamp      int64  // pingMsg and pongMsg
+	Seq        uint64 // dataMsg and ackMsg, in reliable mode (see reliable.go)
+	Version    int    // helloMsg
+	Features   uint64 // helloMsg
+	Identity   string // helloMsg
+	Window     int    // helloMsg, the connection window (see window.go)
+	BatchLen   int    // dataMsg, if the peer has a connection window
 }
 
-type hello struct{}
-
 type data struct {
 	header
 	batch      reflect.Value
 	batchLenPt *int32
+	size       int        // encoded size of the message, set by the decoder
+	sizeCh     chan<- int // to report the encoded size, for byte credits
+	err        error      // set by the decoder: type mismatch or batch decoding error
 }
 
 type credit struct {
@@ -15,7 +15,21 @@ connection.
 
 The connection can be any io.ReadWriteCloser like a TCP connection or unix domain
 sockets. The user is in charge of establishing the connection, which is then handed over
-to a netchan.Session.
+to a netchan.Session. On the accepting side, a Server can do it: it starts a session on
+each connection accepted from a net.Listener, calls a handler with it and shuts all the
+sessions down together.
+
+The first message on the connection is a hello, which carries the protocol version, the
+features and the declared identity of each peer; a peer that speaks an incompatible
+version makes the session fail with ErrIncompatiblePeer. Dial connects and returns the
+session only after the hello exchange succeeds; Session.Handshake waits for it on any
+session.
+
+DialTLS and ListenTLS secure the connection with TLS. When the certificate of the peer
+is verified (for the client, that requires a server configured for mutual
+authentication), Session.PeerIdentity returns its common name, which can be used to
+authorize the peer: SessionOptions.Authorizer is asked about each net-chan that the peer
+opens, and can reject it with an error (see ErrRejected).
 
 A basic netchan session, where a peer sends some integers to the other, looks like the
 following (error handling aside).
@@ -40,17 +54,26 @@ On the receive side:
 
 All methods that Session provides can be called safely from multiple goroutines.
 
-Netchan uses gob to serialize messages (https://golang.org/pkg/encoding/gob/). Any data
-to be transmitted using netchan must obey gob's laws. In particular, channels cannot be
-sent, but it is possible to send net-chans' names.
+By default, netchan uses gob to serialize messages (https://golang.org/pkg/encoding/gob/).
+Any data to be transmitted using netchan must obey gob's laws. In particular, channels
+cannot be sent, but it is possible to send net-chans' names. A different serialization
+format can be plugged in by implementing the Codec interface and creating the session
+with NewSessionCodec.
+
+When a net-chan is opened, the peers exchange a description of the element types of
+their Go channels. With gob, the types are checked according to gob's compatibility
+rules: if the values sent by one peer can not be received by the other, the net-chan
+fails on both sides with a type mismatch error (returned by the open methods if the peer
+opened the net-chan already, or by their Context variants otherwise), while the
+session and the other net-chans keep working.
 
 Error handling
 
-When a session shuts down (because Quit is called or because of an error), some
-goroutines could hang forever trying to receive or send on a net-chan. For this reason,
-Session provides the methods Done and Err. Done returns a channel that
-never gets any message and is closed when an error occurs; Err returns the error that
-occurred. Their intended use:
+When a session shuts down (because Quit is called or because of an error), the values
+in flight may be lost and some goroutines could hang forever trying to receive or send
+on a net-chan. For this reason, Session provides the methods Done and Err. Done returns
+a channel that never gets any message and is closed when an error occurs; Err returns
+the error that occurred. Their intended use:
 
 	// sending on a net-chan (receiving is analogous):
 	select {
@@ -60,9 +83,45 @@ occurred. Their intended use:
 		log.Fatal(s.Err())
 	}
 
-Some errors are not caught by netchan. For example, if one peer opens a net-chan with the
-wrong direction, both peers might end up waiting to receive messages, but none of them
-will send anything. It is advised to use timeouts to identify this kind of errors.
+If one peer opens a net-chan with the wrong direction, both peers might end up waiting
+to receive messages, but none of them will send anything. The messages that open a
+net-chan carry its direction, so when the open of the peer arrives the net-chan fails
+with ErrDirMismatch on both peers; the session is not affected. OpenSendContext and
+OpenRecvContext wait for the peer to open the net-chan and report this kind of errors;
+they also fail when their context expires. A session can also be bound to a context with
+NewSessionContext.
+
+A session does not notice by itself that an idle connection is dead. To detect it, set
+SessionOptions.PingInterval and IdleTimeout: the session then shuts down with
+ErrPeerTimeout if nothing arrives from the peer for too long.
+
+A ResumableSession survives the failures of the connection: it dials a new connection,
+with backoff, opens the net-chans again and retransmits the values that were lost, so
+the application only sees a pause. Both peers must use it.
+
+The buffer of a net-chan opened with OpenRecv holds a number of values, whatever their
+size. OpenRecvBytes bounds it in bytes instead: the credits are measured on the encoded
+messages, so the memory used by the buffer is predictable even for values of variable
+size, such as slices.
+
+With SessionOptions.Reliable, the peer acknowledges the values it delivers; when the
+session ends, NetChan.Unacked returns the values that may have been lost, so that they
+can be sent again on a new session.
+
+Errors that concern a single net-chan, such as a batch that can not be decoded or a peer
+that does not respect the flow control, do not shut down the session: the net-chan is
+reset on both peers and its error can be retrieved with SendErr or RecvErr. OpenSendChan
+and OpenRecvChan return a NetChan handle, which reports the state of a single net-chan
+(Ready, Done, Err, Stats) and allows the receiver to close it (CloseRecv does the same
+for net-chans opened with OpenRecv); the sender then gets ErrClosedByPeer.
+
+To shut down a session without losing values, use Shutdown instead of Quit: it stops
+accepting new net-chans and waits until the net-chans open locally have been closed and
+all their values delivered, before terminating the session.
+
+Session.Stats returns a snapshot of the traffic of a session (bytes, messages, flushes,
+batch lengths, credit stalls, open net-chans), which is always collected. Package
+netchan/metrics exports these statistics through expvar and to Prometheus.
 
 Flow control
 
@@ -77,5 +136,10 @@ messages. The sender must never transmit more than its credit allows.
 The receive channel capacity can affect performance: a small buffer could cause the
 sender to suspend often, waiting for credit; a big buffer could avoid suspensions
 completely.
+
+As in HTTP/2, the session can also have a connection window (SessionOptions.ConnWindow),
+which bounds the values in the receive buffers of all the net-chans together: the
+receiver announces it in the hello message and replenishes it with connection credit
+messages, and each net-chan of the sender can use an equal share of it.
 */
 package netchan
@@ -2,13 +2,13 @@ package netchan
 
 import (
 	"bufio"
-	"encoding/gob"
 	"errors"
 	"io"
+	"log/slog"
 	"reflect"
 	"runtime"
-	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type bufWriter interface {
@@ -34,52 +34,67 @@ type encoder struct {
 	dataCh   <-chan data
 	creditCh <-chan credit
 	countWr  countWriter
-	enc      *gob.Encoder
+	enc      Encoder
 	flush    func() error
 
-	err        error
-	flushStats stats
+	err    error
+	msgs   int          // messages encoded since the last flush
+	pongCh <-chan int64 // stamps of the pings to answer, from the decoder
 }
 
 func newEncoder(ssn *Session, dataCh <-chan data, creditCh <-chan credit,
-	conn io.Writer) *encoder {
+	conn io.Writer, codec Codec) *encoder {
 	e := &encoder{ssn: ssn, dataCh: dataCh, creditCh: creditCh}
 	bw, ok := conn.(bufWriter)
 	if !ok {
 		bw = bufio.NewWriter(conn)
 	}
 	e.countWr = countWriter{w: bw}
-	e.enc = gob.NewEncoder(&e.countWr)
+	e.enc = codec.NewEncoder(&e.countWr)
 	e.flush = bw.Flush
 	return e
 }
 
-func (e *encoder) encode(val interface{}) {
+func (e *encoder) encode(h header) {
 	// when an encoding error occurs, encode operations turn into NOPs
 	if e.err != nil {
 		return
 	}
-	e.err = e.enc.EncodeValue(reflect.ValueOf(val))
+	start := e.countWr.flushBytes
+	e.err = e.enc.EncodeHeader(h)
+	e.msgs++
+	if e.err == nil && h.Type != dataMsg {
+		e.ssn.trace(true, &h, 0, e.countWr.flushBytes-start)
+	}
 }
 
-const wantBatchSize = 4096
+func (e *encoder) encodeCredit(c credit) {
+	c.Credit = c.amount
+	e.encode(c.header)
+}
 
 func (e *encoder) handleData(dat data) {
+	start := e.countWr.flushBytes
 	e.encode(dat.header)
 	if e.err != nil || dat.Type == initDataMsg || dat.Type == closeMsg {
 		return
 	}
 	// dat.Type is dataMsg
 	e.countWr.batchBytes = 0
-	e.err = e.enc.EncodeValue(dat.batch)
+	e.err = e.enc.EncodeBatch(dat.batch)
 	if e.err != nil {
 		return
 	}
+	e.ssn.trace(true, &dat.header, dat.batch.Len(), e.countWr.flushBytes-start)
+	if dat.sizeCh != nil {
+		// never blocks, the sendProxy waits for the size of each batch
+		dat.sizeCh <- e.countWr.flushBytes - start
+	}
 	itemSize := float64(e.countWr.batchBytes) / float64(dat.batch.Len())
 	if itemSize < 1 {
 		itemSize = 1
 	}
-	wantBatchLen := wantBatchSize / itemSize
+	wantBatchLen := float64(e.ssn.opts.BatchSize) / itemSize
 	if wantBatchLen < 1 {
 		wantBatchLen = 1
 	}
@@ -93,8 +108,7 @@ func (e *encoder) bufAndFlush() {
 	for i := 0; i < cap(e.creditCh); i++ {
 		select {
 		case c := <-e.creditCh:
-			e.encode(c.header)
-			e.encode(c.amount)
+			e.encodeCredit(c)
 			continue
 		default:
 		}
@@ -119,15 +133,31 @@ func (e *encoder) bufAndFlush() {
 	if e.err != nil {
 		return
 	}
-	e.flushStats.update(float64(e.countWr.flushBytes))
-	e.countWr.flushBytes = 0
+	e.countStats()
 	e.err = e.flush()
 }
 
+// countStats updates the statistics of the session before a flush.
+func (e *encoder) countStats() {
+	atomic.AddInt64(&e.ssn.stats.bytesSent, int64(e.countWr.flushBytes))
+	atomic.AddInt64(&e.ssn.stats.msgsSent, int64(e.msgs))
+	atomic.AddInt64(&e.ssn.stats.flushes, 1)
+	if e.ssn.opts.Metrics != nil {
+		e.ssn.opts.Metrics.Flushed(e.countWr.flushBytes)
+	}
+	e.countWr.flushBytes = 0
+	e.msgs = 0
+}
+
 func (e *encoder) run() {
-	e.encode(header{Type: helloMsg})
-	e.encode(hello{})
+	e.encode(e.ssn.helloHeader())
 	e.bufAndFlush()
+	var pingC <-chan time.Time
+	if e.ssn.opts.PingInterval > 0 {
+		ticker := time.NewTicker(e.ssn.opts.PingInterval)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
 Loop:
 	for {
 		if e.err != nil {
@@ -138,19 +168,29 @@ Loop:
 		case d := <-e.dataCh:
 			e.handleData(d)
 		case c := <-e.creditCh:
-			e.encode(c.header)
-			e.encode(c.amount)
+			e.encodeCredit(c)
+		case <-pingC:
+			stamp := e.ssn.stamp()
+			e.ssn.rtt.ping(stamp)
+			e.encode(header{Type: pingMsg, Stamp: stamp})
+		case stamp := <-e.pongCh:
+			e.encode(header{Type: pongMsg, Stamp: stamp})
+		case <-e.ssn.recvWindow.notify:
+			if due := atomic.SwapInt64(&e.ssn.recvWindow.due, 0); due > 0 {
+				e.encode(header{Type: connCreditMsg, Credit: int(due)})
+			}
 		case <-e.ssn.Done():
 			break Loop
 		}
 		e.bufAndFlush()
 	}
 
-	e.encode(header{Type: errorMsg})
-	e.encode(e.ssn.Err().Error())
+	e.encode(header{Type: errorMsg, Err: e.ssn.Err().Error()})
+	e.countStats()
 	e.flush()
-	logDebug("netchan session %d is done, flushBytes stats:\n\t%s",
-		e.ssn.id, &e.flushStats)
+	st := e.ssn.Stats()
+	e.ssn.logSession(slog.LevelDebug, "traffic", slog.Int64("bytes_sent", st.BytesSent),
+		slog.Int64("flushes", st.Flushes), slog.Int64("bytes_received", st.BytesReceived))
 	e.ssn.closeConn()
 }
 
@@ -161,14 +201,16 @@ type bufReader interface {
 
 // Like io.LimitedReader, but returns a custom error.
 type limitedReader struct {
-	bufReader     // underlying reader
-	n         int // max bytes remaining
+	bufReader       // underlying reader
+	n         int   // max bytes remaining
+	err       error // last read error
 }
 
-var errMsgTooBig = fmtErr("too big gob message received")
+var errMsgTooBig = fmtErr("too big message received")
 
 func (l *limitedReader) Read(p []byte) (m int, err error) {
 	if l.n <= 0 {
+		l.err = errMsgTooBig
 		return 0, errMsgTooBig
 	}
 	if len(p) > l.n {
@@ -176,14 +218,12 @@ func (l *limitedReader) Read(p []byte) (m int, err error) {
 	}
 	m, err = l.bufReader.Read(p)
 	l.n -= m
+	if err != nil {
+		l.err = err
+	}
 	return
 }
 
-type typeTable struct {
-	sync.Mutex
-	batchType map[int]reflect.Type
-}
-
 type decoder struct {
 	ssn          *Session
 	toRecvMn     chan<- data
@@ -191,25 +231,45 @@ type decoder struct {
 	msgSizeLimit int
 	types        typeTable // updated by recvManager
 	limitedRd    limitedReader
-	dec          *gob.Decoder
+	dec          Decoder
+	hdrSize      int          // size of the last header decoded
+	lastRecv     int64        // when the last message arrived, in Unix nanoseconds
+	pongCh       chan<- int64 // to ask the encoder for a pong
 }
 
 func newDecoder(ssn *Session, dataCh chan<- data, creditCh chan<- credit,
-	conn io.Reader, lim int) *decoder {
+	conn io.Reader, lim int, codec Codec) *decoder {
 	d := &decoder{ssn: ssn, toRecvMn: dataCh, toSendMn: creditCh, msgSizeLimit: lim}
-	d.types.batchType = make(map[int]reflect.Type)
+	d.types.init()
 	br, ok := conn.(bufReader)
 	if !ok {
 		br = bufio.NewReader(conn)
 	}
 	d.limitedRd = limitedReader{bufReader: br}
-	d.dec = gob.NewDecoder(&d.limitedRd)
+	d.dec = codec.NewDecoder(&d.limitedRd)
 	return d
 }
 
-func (d *decoder) decode(val interface{}) error {
+func (d *decoder) decode(h *header) error {
 	d.limitedRd.n = d.msgSizeLimit
-	return d.dec.DecodeValue(reflect.ValueOf(val))
+	err := d.dec.DecodeHeader(h)
+	d.hdrSize = d.countRead()
+	if err == nil {
+		atomic.StoreInt64(&d.lastRecv, time.Now().UnixNano())
+		atomic.AddInt64(&d.ssn.stats.msgsRecv, 1)
+		if h.Type != dataMsg {
+			d.ssn.trace(false, h, 0, d.hdrSize)
+		}
+	}
+	return err
+}
+
+// countRead adds the bytes read since limitedRd was reset to the session statistics
+// and returns them.
+func (d *decoder) countRead() int {
+	n := d.msgSizeLimit - d.limitedRd.n
+	atomic.AddInt64(&d.ssn.stats.bytesRecv, int64(n))
+	return n
 }
 
 func (d *decoder) run() (err error) {
@@ -218,6 +278,7 @@ func (d *decoder) run() (err error) {
 		close(d.toSendMn)
 		d.ssn.QuitWith(err)
 	}()
+	d.watchIdle()
 
 	var h header
 	err = d.decode(&h)
@@ -227,9 +288,7 @@ func (d *decoder) run() (err error) {
 	if h.Type != helloMsg {
 		return fmtErr("expecting hello message, got Type %d", h.Type)
 	}
-	var hel hello
-	err = d.decode(&hel)
-	if err != nil {
+	if err = d.ssn.handleHello(h); err != nil {
 		return
 	}
 	for {
@@ -247,29 +306,78 @@ func (d *decoder) run() (err error) {
 			return fmtErr("hello message received again")
 
 		case dataMsg:
-			d.types.Lock()
-			batchType, present := d.types.batchType[h.ChId]
-			d.types.Unlock()
+			// Batches of unknown or failed net-chans are discarded (batchType is nil).
+			batchType, present := d.types.get(h.ChId)
+			d.limitedRd.n = d.msgSizeLimit
+			d.limitedRd.err = nil
+			var batch reflect.Value
+			batch, err = d.dec.DecodeBatch(batchType)
+			size := d.hdrSize + d.countRead()
+			batchLen := 0
+			if batch.IsValid() {
+				batchLen = batch.Len()
+			}
+			d.ssn.trace(false, &h, batchLen, size)
+			if err != nil && (d.limitedRd.err != nil || batchType == nil) {
+				return // the connection is broken
+			}
+			if err == nil && batch.IsValid() && batch.Len() != h.BatchLen &&
+				d.ssn.opts.ConnWindow > 0 {
+				return fmtErr("batch of %d values received, with BatchLen %d", batch.Len(),
+					h.BatchLen)
+			}
+			if winErr := d.ssn.chargeWindow(h.BatchLen); winErr != nil {
+				return winErr
+			}
 			if !present {
-				return fmtErr("message with invalid ID received (%d)\n", h.ChId)
+				d.ssn.returnWindow(h.BatchLen)
+				d.ssn.logChan(slog.LevelDebug, "data for unknown channel discarded", dirRecv,
+					"", h.ChId)
+				continue
 			}
-			batch := reflect.New(batchType).Elem()
-			d.limitedRd.n = d.msgSizeLimit
-			err = d.dec.DecodeValue(batch)
 			if err != nil {
-				return
+				// The connection did not fail, so only this net-chan fails.
+				d.types.discard(h.ChId)
+				d.toRecvMn <- data{header: h,
+					err: fmtErr("could not decode batch: %s", err)}
+				err = nil
+				continue
+			}
+			if batchType == nil {
+				d.ssn.returnWindow(h.BatchLen)
+				continue
 			}
-			d.toRecvMn <- data{header: h, batch: batch}
+			d.toRecvMn <- data{header: h, batch: batch, size: size}
+
+		case initDataMsg:
+			typeErr := d.types.addRemote(h.ChName, h.typeInfo())
+			d.toRecvMn <- data{header: h, err: typeErr}
 
-		case initDataMsg, closeMsg:
+		case closeMsg:
 			d.toRecvMn <- data{header: h}
 
-		case creditMsg:
-			c := credit{header: h}
-			err = d.decode(&c.amount)
-			if err != nil {
+		case cancelMsg, resetMsg, closeAckMsg, ackMsg, rejectMsg:
+			d.toSendMn <- credit{header: h}
+
+		case pingMsg:
+			select {
+			case d.pongCh <- h.Stamp:
+			default: // a pong is already pending
+			}
+
+		case pongMsg:
+			d.ssn.rtt.pong(h.Stamp, d.ssn.stamp())
+
+		case connCreditMsg:
+			if h.Credit <= 0 {
+				return fmtErr("received connection credit with non-positive amount")
+			}
+			if err = d.ssn.window.add(h.Credit); err != nil {
 				return
 			}
+
+		case creditMsg:
+			c := credit{header: h, amount: h.Credit}
 			// sendManager expects only positive credits.
 			if c.amount == 0 {
 				continue
@@ -280,26 +388,17 @@ func (d *decoder) run() (err error) {
 			d.toSendMn <- c
 
 		case initCreditMsg:
-			c := credit{header: h}
-			err = d.decode(&c.amount)
-			if err != nil {
-				return
-			}
+			c := credit{header: h, amount: h.Credit}
 			if c.amount < 1 {
 				return fmtErr("received initial credit with non-positive amount")
 			}
 			d.toSendMn <- c
 
 		case errorMsg:
-			var errStr string
-			err = d.decode(&errStr)
-			if err != nil {
-				return
-			}
-			if errStr == EndOfSession.Error() {
+			if h.Err == EndOfSession.Error() {
 				return EndOfSession
 			}
-			return errors.New("error from netchan peer: " + errStr)
+			return errors.New("error from netchan peer: " + h.Err)
 
 		default:
 			if h.Type < 0 || h.Type > lastReservedMsg {
@@ -0,0 +1,162 @@
+package netchan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrIncompatiblePeer is the error of a session whose peer speaks a different version
+// of the netchan protocol or lacks a feature that the session needs. The error of the
+// session wraps it, with the details.
+var ErrIncompatiblePeer = errors.New("netchan: incompatible peer")
+
+// ErrHandshakeTimeout is the error of a session that did not receive the hello message
+// of the peer within SessionOptions.HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("netchan: handshake timed out")
+
+// ProtocolVersion is the version of the netchan protocol implemented by this package.
+// Peers must speak the same version.
+const ProtocolVersion = 1
+
+// Feature flags, announced in the hello message (see PeerInfo.Features).
+const (
+	// FeatureAcks means that the peer acknowledges the batches sent in reliable mode
+	// (see SessionOptions.Reliable).
+	FeatureAcks uint64 = 1 << iota
+	// FeatureByteCredits means that the peer can send on net-chans whose credits are
+	// counted in bytes (see Session.OpenRecvBytes).
+	FeatureByteCredits
+	// FeatureConnWindow means that the peer respects the connection window (see
+	// SessionOptions.ConnWindow).
+	FeatureConnWindow
+)
+
+// localFeatures are the features implemented by this package.
+const localFeatures = FeatureAcks | FeatureByteCredits | FeatureConnWindow
+
+/*
+The first message of each peer is the hello message, which carries the protocol version,
+the features of the peer and its identity, as declared with SessionOptions.Identity. The
+decoder checks it before anything else: a peer with a different version, or without a
+feature that the session needs, makes the session fail with ErrIncompatiblePeer. When the
+hello has been accepted, the decoder records the PeerInfo and closes Session.hello, which
+Handshake and Dial wait for.
+*/
+
+// PeerInfo describes the peer of a session, as announced in its hello message.
+type PeerInfo struct {
+	Version  int    // version of the protocol
+	Features uint64 // feature flags, such as FeatureAcks
+	// Identity is the one declared by the peer with SessionOptions.Identity; it is not
+	// verified in any way.
+	Identity string
+}
+
+// helloHeader returns the hello message of the session.
+func (m *Session) helloHeader() header {
+	return header{Type: helloMsg, Version: ProtocolVersion, Features: localFeatures,
+		Identity: m.opts.Identity, Window: m.opts.ConnWindow}
+}
+
+// handleHello checks the hello message of the peer. It is called by the decoder.
+func (m *Session) handleHello(h header) error {
+	if h.Version != ProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d, expected %d", ErrIncompatiblePeer,
+			h.Version, ProtocolVersion)
+	}
+	if m.opts.Reliable && h.Features&FeatureAcks == 0 {
+		return fmt.Errorf("%w: the peer does not acknowledge batches, required by the "+
+			"reliable mode", ErrIncompatiblePeer)
+	}
+	if m.opts.ConnWindow > 0 && h.Features&FeatureConnWindow == 0 {
+		return fmt.Errorf("%w: the peer does not respect the connection window",
+			ErrIncompatiblePeer)
+	}
+	if h.Window < 0 {
+		return fmtErr("negative connection window in hello message")
+	}
+	if h.Features&FeatureConnWindow != 0 {
+		m.window.setSize(h.Window)
+	}
+	m.peer = PeerInfo{Version: h.Version, Features: h.Features, Identity: h.Identity}
+	m.peerCert = verifiedPeerCert(m.conn)
+	close(m.hello)
+	return nil
+}
+
+// watchHandshake makes the session fail if the hello message of the peer does not
+// arrive within SessionOptions.HandshakeTimeout.
+func (m *Session) watchHandshake() {
+	if m.opts.HandshakeTimeout <= 0 {
+		return
+	}
+	timer := time.NewTimer(m.opts.HandshakeTimeout)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			m.QuitWith(ErrHandshakeTimeout)
+		case <-m.hello:
+		case <-m.Done():
+		}
+	}()
+}
+
+// Handshake waits until the hello message of the peer has arrived and has been
+// accepted, which proves that the peer speaks a compatible version of the netchan
+// protocol. If the session shuts down first, its error is returned; if ctx is done
+// first, ctx.Err() is returned and the session keeps running.
+func (m *Session) Handshake(ctx context.Context) error {
+	select {
+	case <-m.hello:
+		return nil
+	case <-m.Done():
+		return m.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Peer returns the information that the peer announced in its hello message. It
+// returns the zero PeerInfo until the handshake is complete (see Handshake).
+func (m *Session) Peer() PeerInfo {
+	select {
+	case <-m.hello:
+		return m.peer
+	default:
+		return PeerInfo{}
+	}
+}
+
+// Dial connects to the address addr on the named network, like net.Dial, and starts a
+// session on the connection with the options opts, which can be nil. Unlike NewSession,
+// Dial returns only when the handshake is complete, so a wrong or incompatible endpoint
+// is reported right away. If ctx is done before that, or the handshake fails, the
+// session is terminated and the error is returned.
+func Dial(ctx context.Context, network, addr string, opts *SessionOptions) (*Session,
+	error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return startSession(ctx, conn, opts)
+}
+
+// startSession starts a session on a dialed connection and waits for the handshake.
+func startSession(ctx context.Context, conn net.Conn, opts *SessionOptions) (*Session,
+	error) {
+	ssn, err := NewSessionWithOptions(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := ssn.Handshake(ctx); err != nil {
+		ssn.QuitWith(err)
+		return nil, err
+	}
+	return ssn, nil
+}
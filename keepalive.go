@@ -0,0 +1,134 @@
+package netchan
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPeerTimeout is the error of a session that did not receive anything from the peer
+// for SessionOptions.IdleTimeout.
+var ErrPeerTimeout = errors.New("netchan: peer timed out")
+
+/*
+Keepalive works with two message types. The encoder sends a pingMsg every
+SessionOptions.PingInterval and the peer answers with a pongMsg, so a session that
+pings gets some traffic back even if the peer is idle. The decoder can't send the pong
+itself (it must never send to the encoder, see the graph in session.go): it signals the
+encoder on pongCh, without blocking. Pings that arrive while a pong is pending are
+dropped.
+
+Pings carry a stamp, the time elapsed since the start of the session, which the pong
+echoes back. When the pong arrives, the difference with the current stamp is a sample of
+the round-trip time. Only the session that sent the ping interprets the stamp, so the
+clocks of the peers need not be synchronized. The encoder records the stamps of the
+pings that have not been answered yet (the last maxPings of them) and only a pong with
+one of those stamps is a sample, so unsolicited pongs and pongs with a forged stamp are
+ignored. The peer answers the pings in order, so a pong also settles the pings that
+precede it, which the peer dropped.
+
+The idle timeout is enforced by a watchdog timer, independent of the decoder, which is
+blocked in a read when the connection is dead. The decoder only records the time of the
+last message received; the watchdog shuts the session down when that is too old. Then
+the connection is closed (see Session.QuitWith) and the blocked read fails.
+*/
+
+// stamp returns the current time, for the pings.
+func (m *Session) stamp() int64 {
+	return int64(time.Since(m.start))
+}
+
+// maxPings is the number of unanswered pings whose pongs are still accepted.
+const maxPings = 16
+
+// RTT estimates, in nanoseconds.
+type rttStats struct {
+	last, smoothed int64
+
+	mu    sync.Mutex
+	pings []int64 // stamps of the pings not answered yet, in order
+}
+
+// ping records the stamp of a ping. It is called only by the encoder.
+func (r *rttStats) ping(stamp int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pings) == maxPings {
+		copy(r.pings, r.pings[1:])
+		r.pings = r.pings[:maxPings-1]
+	}
+	r.pings = append(r.pings, stamp)
+}
+
+// pong adds a sample if stamp is the one of a ping not answered yet; now is the current
+// stamp. It is called only by the decoder.
+func (r *rttStats) pong(stamp, now int64) {
+	r.mu.Lock()
+	i := 0
+	for i < len(r.pings) && r.pings[i] != stamp {
+		i++
+	}
+	found := i < len(r.pings)
+	if found {
+		r.pings = append(r.pings[:0], r.pings[i+1:]...)
+	}
+	r.mu.Unlock()
+	if found {
+		r.update(now - stamp)
+	}
+}
+
+// update adds a sample.
+func (r *rttStats) update(sample int64) {
+	if sample <= 0 {
+		return
+	}
+	atomic.StoreInt64(&r.last, sample)
+	smoothed := atomic.LoadInt64(&r.smoothed)
+	if smoothed == 0 {
+		smoothed = sample
+	} else {
+		smoothed += (sample - smoothed) / 8 // as TCP, see RFC 6298
+	}
+	atomic.StoreInt64(&r.smoothed, smoothed)
+}
+
+// RTT returns the last measure of the round-trip time to the peer and back, 0 if it
+// has not been measured yet. The round-trip time is measured only if pings are enabled
+// (see SessionOptions.PingInterval), with each ping; it includes the time that the
+// messages spend queued behind the traffic of the net-chans.
+func (m *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.rtt.last))
+}
+
+// SmoothedRTT returns an exponentially weighted moving average of the round-trip
+// time, which is less sensitive than RTT to the peaks of latency; it is 0 if the
+// round-trip time has not been measured yet.
+func (m *Session) SmoothedRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.rtt.smoothed))
+}
+
+// watchIdle starts the watchdog of the decoder, if the session has an idle timeout.
+func (d *decoder) watchIdle() {
+	timeout := d.ssn.opts.IdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	atomic.StoreInt64(&d.lastRecv, time.Now().UnixNano())
+	var check func()
+	check = func() {
+		if d.ssn.Err() != nil {
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&d.lastRecv)))
+		if idle >= timeout {
+			d.ssn.logSession(slog.LevelWarn, "peer timed out")
+			go d.ssn.QuitWith(ErrPeerTimeout)
+			return
+		}
+		time.AfterFunc(timeout-idle, check)
+	}
+	time.AfterFunc(timeout, check)
+}
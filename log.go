@@ -0,0 +1,49 @@
+package netchan
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Attribute keys of the records logged with SessionOptions.Logger.
+const (
+	LogKeySession = "session" // id of the session
+	LogKeyChan    = "chan"    // name of the net-chan
+	LogKeyChanId  = "chan_id" // id of the net-chan, 0 if not known yet
+	LogKeyDir     = "dir"     // direction of the net-chan, "send" or "recv"
+)
+
+// Directions of a net-chan, as logged with the LogKeyDir attribute.
+const (
+	dirSend = "send"
+	dirRecv = "recv"
+)
+
+// logSession logs an event that concerns the whole session. The event goes to
+// SessionOptions.Logger or, if it is nil, to the debug log.
+func (m *Session) logSession(level slog.Level, msg string, attrs ...slog.Attr) {
+	if sl := m.opts.Logger; sl != nil {
+		attrs = append([]slog.Attr{slog.Int64(LogKeySession, m.id)}, attrs...)
+		sl.LogAttrs(context.Background(), level, msg, attrs...)
+		return
+	}
+	if !debugEnabled {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "netchan session %d: %s", m.id, msg)
+	for _, a := range attrs {
+		fmt.Fprintf(&b, " %s=%s", a.Key, a.Value)
+	}
+	logDebug("%s", b.String())
+}
+
+// logChan logs an event that concerns a single net-chan.
+func (m *Session) logChan(level slog.Level, msg, dir, chName string, chId int,
+	attrs ...slog.Attr) {
+	attrs = append([]slog.Attr{slog.String(LogKeyChan, chName), slog.Int(LogKeyChanId, chId),
+		slog.String(LogKeyDir, dir)}, attrs...)
+	m.logSession(level, msg, attrs...)
+}
@@ -0,0 +1,227 @@
+/*
+Package metrics exports the statistics of netchan sessions (see netchan.Session.Stats)
+to monitoring systems, through expvar and in the Prometheus text format.
+
+Sessions are added to a Registry with a name, which becomes the label that identifies
+them; they are removed automatically when they shut down. A Registry is an expvar.Var
+and an http.Handler that serves the Prometheus metrics:
+
+	reg := metrics.NewRegistry()
+	expvar.Publish("netchan", reg)
+	http.Handle("/metrics", reg)
+	...
+	reg.Register("client-42", session)
+
+The package does not depend on the Prometheus client libraries: the handler writes the
+text exposition format directly.
+*/
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pinkgopher/netchan"
+)
+
+// A Registry holds a set of live sessions, by name. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string]*netchan.Session
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[string]*netchan.Session)}
+}
+
+// Register adds ssn to the registry with the given name, replacing the session that
+// was registered with that name, if any. The session is removed when it shuts down.
+func (r *Registry) Register(name string, ssn *netchan.Session) {
+	r.mu.Lock()
+	r.sessions[name] = ssn
+	r.mu.Unlock()
+	go func() {
+		<-ssn.Done()
+		r.mu.Lock()
+		if r.sessions[name] == ssn {
+			delete(r.sessions, name)
+		}
+		r.mu.Unlock()
+	}()
+}
+
+// Unregister removes the session with the given name from the registry.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	delete(r.sessions, name)
+	r.mu.Unlock()
+}
+
+type sessionStats struct {
+	name string
+	netchan.SessionStats
+}
+
+// snapshot returns the statistics of the registered sessions, sorted by name.
+func (r *Registry) snapshot() []sessionStats {
+	r.mu.Lock()
+	sessions := make([]sessionStats, 0, len(r.sessions))
+	for name, ssn := range r.sessions {
+		sessions = append(sessions, sessionStats{name: name, SessionStats: ssn.Stats()})
+	}
+	r.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].name < sessions[j].name })
+	return sessions
+}
+
+// String returns the statistics of the registered sessions as a JSON object, whose
+// keys are the names of the sessions and whose values are netchan.SessionStats. It
+// implements expvar.Var.
+func (r *Registry) String() string {
+	all := make(map[string]netchan.SessionStats)
+	for _, s := range r.snapshot() {
+		all[s.name] = s.SessionStats
+	}
+	js, err := json.Marshal(all)
+	if err != nil {
+		return "{}"
+	}
+	return string(js)
+}
+
+// ServeHTTP serves the statistics of the registered sessions in the Prometheus text
+// exposition format. Each metric has a session label; the metrics of single net-chans
+// also have chan and dir ("send" or "recv") labels.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+// counters and gauges with a single value per session
+var sessionMetrics = [...]struct {
+	name, kind, help string
+	value            func(*netchan.SessionStats) int64
+}{
+	{"netchan_bytes_sent_total", "counter", "Bytes written to the connection.",
+		func(st *netchan.SessionStats) int64 { return st.BytesSent }},
+	{"netchan_bytes_received_total", "counter", "Bytes read from the connection.",
+		func(st *netchan.SessionStats) int64 { return st.BytesReceived }},
+	{"netchan_messages_sent_total", "counter", "Protocol messages sent.",
+		func(st *netchan.SessionStats) int64 { return st.MsgsSent }},
+	{"netchan_messages_received_total", "counter", "Protocol messages received.",
+		func(st *netchan.SessionStats) int64 { return st.MsgsReceived }},
+	{"netchan_flushes_total", "counter", "Flushes of the connection.",
+		func(st *netchan.SessionStats) int64 { return st.Flushes }},
+	{"netchan_items_sent_total", "counter", "Values sent on all the net-chans.",
+		func(st *netchan.SessionStats) int64 { return st.ItemsSent }},
+	{"netchan_items_received_total", "counter", "Values received on all the net-chans.",
+		func(st *netchan.SessionStats) int64 { return st.ItemsReceived }},
+	{"netchan_credit_stalls_total", "counter",
+		"Times a net-chan had to wait for credit from the peer.",
+		func(st *netchan.SessionStats) int64 { return st.CreditStalls }},
+	{"netchan_open_chans", "gauge", "Net-chans opened by both peers.",
+		func(st *netchan.SessionStats) int64 { return int64(st.OpenChans) }},
+	{"netchan_half_open_chans", "gauge", "Net-chans opened by only one peer.",
+		func(st *netchan.SessionStats) int64 { return int64(st.HalfOpenChans) }},
+}
+
+// WritePrometheus writes the statistics of the registered sessions to w, in the
+// Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	sessions := r.snapshot()
+	pw := &promWriter{w: w}
+	for _, m := range sessionMetrics {
+		pw.header(m.name, m.kind, m.help)
+		for i := range sessions {
+			pw.sample(m.name, m.value(&sessions[i].SessionStats), "session",
+				sessions[i].name)
+		}
+	}
+
+	// The buckets of BatchLens are disjoint ranges of lengths, Prometheus wants
+	// cumulative counts with upper bounds.
+	pw.header("netchan_batch_length", "histogram", "Length of the batches sent.")
+	for _, s := range sessions {
+		var count int64
+		for i, n := range s.BatchLens {
+			count += n
+			le := "+Inf"
+			if i < len(s.BatchLens)-1 {
+				le = fmt.Sprint(1<<uint(i+1) - 1)
+			}
+			pw.sample("netchan_batch_length_bucket", count, "session", s.name, "le", le)
+		}
+		pw.sample("netchan_batch_length_sum", s.ItemsSent, "session", s.name)
+		pw.sample("netchan_batch_length_count", count, "session", s.name)
+	}
+
+	pw.header("netchan_chan_items_total", "counter",
+		"Values sent or received on the net-chans open locally.")
+	forEachChan(sessions, func(s *sessionStats, ch, dir string, st netchan.ChanStats) {
+		pw.sample("netchan_chan_items_total", st.Items, "session", s.name, "chan", ch,
+			"dir", dir)
+	})
+	pw.header("netchan_chan_pending", "gauge",
+		"Values in flight or buffered on the net-chans open locally.")
+	forEachChan(sessions, func(s *sessionStats, ch, dir string, st netchan.ChanStats) {
+		pw.sample("netchan_chan_pending", st.Pending, "session", s.name, "chan", ch,
+			"dir", dir)
+	})
+	return pw.err
+}
+
+// forEachChan calls f for each net-chan of sessions, in a stable order.
+func forEachChan(sessions []sessionStats,
+	f func(s *sessionStats, ch, dir string, st netchan.ChanStats)) {
+	for i := range sessions {
+		s := &sessions[i]
+		for _, dir := range [...]string{"send", "recv"} {
+			chans := s.Send
+			if dir == "recv" {
+				chans = s.Recv
+			}
+			names := make([]string, 0, len(chans))
+			for name := range chans {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				f(s, name, dir, chans[name])
+			}
+		}
+	}
+}
+
+// promWriter writes the text exposition format, remembering the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) header(name, kind, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample; labels are name-value pairs.
+func (p *promWriter) sample(name string, value int64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i],
+			labelEscaper.Replace(labels[i+1])))
+	}
+	p.printf("%s{%s} %d\n", name, strings.Join(pairs, ","), value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,140 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinkgopher/netchan"
+	"github.com/pinkgopher/netchan/metrics"
+)
+
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (c pipeConn) Close() error {
+	c.PipeReader.Close()
+	c.PipeWriter.Close()
+	return nil // ignoring errors
+}
+
+func newPipeConn() (sideA, sideB pipeConn) {
+	sideA.PipeReader, sideB.PipeWriter = io.Pipe()
+	sideB.PipeReader, sideA.PipeWriter = io.Pipe()
+	return
+}
+
+// newSessions returns two connected sessions; 100 integers have been sent from the
+// first to the second on net-chan "integers", which is still open.
+func newSessions(t *testing.T) (mnA, mnB *netchan.Session) {
+	sideA, sideB := newPipeConn()
+	mnA = netchan.NewSession(sideA)
+	mnB = netchan.NewSession(sideB)
+	sendCh := make(chan int)
+	if err := mnA.OpenSend("integers", sendCh); err != nil {
+		t.Fatal(err)
+	}
+	recvCh := make(chan int, 10)
+	if err := mnB.OpenRecv("integers", recvCh, 10); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 100; i++ {
+			sendCh <- i
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		<-recvCh
+	}
+	waitFor(t, "credits", func() bool { // let the credits arrive
+		return mnA.Stats().Send["integers"].Pending == 0
+	})
+	return
+}
+
+// waitFor polls cond until it returns true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	mnA, mnB := newSessions(t)
+	reg := metrics.NewRegistry()
+	reg.Register("a", mnA)
+	reg.Register(`b "quoted"`, mnB)
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE netchan_bytes_sent_total counter",
+		`netchan_items_sent_total{session="a"} 100`,
+		`netchan_items_received_total{session="b \"quoted\""} 100`,
+		`netchan_open_chans{session="a"} 1`,
+		`netchan_batch_length_sum{session="a"} 100`,
+		`netchan_chan_items_total{session="a",chan="integers",dir="send"} 100`,
+		`netchan_chan_items_total{session="b \"quoted\"",chan="integers",dir="recv"} 100`,
+		`netchan_chan_pending{session="b \"quoted\"",chan="integers",dir="recv"} 0`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("line %q not found in:\n%s", line, text)
+		}
+	}
+
+	// sessions that shut down are removed
+	mnA.Quit()
+	<-mnB.Done()
+	waitFor(t, "the sessions to be removed", func() bool {
+		var buf strings.Builder
+		if err := reg.WritePrometheus(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return !strings.Contains(buf.String(), "session=")
+	})
+}
+
+func TestExpvar(t *testing.T) {
+	mnA, mnB := newSessions(t)
+	defer mnA.Quit()
+	reg := metrics.NewRegistry()
+	reg.Register("a", mnA)
+	reg.Register("b", mnB)
+	var v expvar.Var = reg // the registry can be published with expvar.Publish
+
+	var all map[string]netchan.SessionStats
+	if err := json.Unmarshal([]byte(v.String()), &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["a"].ItemsSent != 100 || all["b"].ItemsReceived != 100 {
+		t.Fatalf("unexpected stats: %+v", all)
+	}
+	if all["a"].Send["integers"].Items != 100 {
+		t.Fatalf("unexpected net-chan stats: %+v", all["a"].Send)
+	}
+}
@@ -0,0 +1,76 @@
+package netchan
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// ErrDirMismatch is the error of a net-chan that has been opened with the same
+// direction by both peers, while none of them opened it with the opposite direction.
+// The directions are checked when the open of the peer arrives, so a name used in both
+// directions must be opened in the second direction before that (see Session.OpenSend).
+var ErrDirMismatch = errors.New(
+	"netchan: net-chan opened with the same direction by both peers")
+
+/*
+It is possible to open two net-chans with the same name and opposite directions, so a
+peer that opened "foo" for sending could open it for receiving later. The messages that
+open a net-chan (initDataMsg is sent by the sender, initCreditMsg by the receiver) carry
+the directions in which the peer has opened the name so far (Dirs). When the open of
+the peer arrives, or when a net-chan is opened locally after the open of the peer, the
+session checks the directions: if both peers opened "foo" for sending (or receiving) and
+none of them had it open in the opposite direction, the local open fails with
+ErrDirMismatch. Both peers do the same check, each with the directions announced by the
+other, so each of them cancels its own half of the mismatch. A peer that uses a name in
+both directions must open the second direction before the open of the first one can
+reach the peer, or the two peers must open the directions in opposite orders. Older
+peers do not send Dirs and their opens are never considered mismatched.
+*/
+
+// Directions in which a net-chan name has been opened, sent in header.Dirs.
+const (
+	openedSend uint8 = 1 << iota
+	openedRecv
+)
+
+// openDirs returns the directions in which chName is open locally.
+func (m *Session) openDirs(chName string) uint8 {
+	var dirs uint8
+	if m.sendMn.info(chName).isOpenLocal {
+		dirs |= openedSend
+	}
+	if m.recvMn.info(chName).isOpenLocal {
+		dirs |= openedRecv
+	}
+	return dirs
+}
+
+// checkDirections is called when a net-chan is opened, locally or by the peer, and
+// the open is not matched yet. It cancels the local open if it is mismatched.
+func (m *Session) checkDirections(chName string) {
+	send, recv := m.mismatched(chName)
+	if send != nil && send.cancel(ErrDirMismatch) {
+		m.logChan(slog.LevelWarn, "channel opened for sending by both peers", dirSend,
+			chName, 0)
+	}
+	if recv != nil && recv.cancel(ErrDirMismatch) {
+		m.logChan(slog.LevelWarn, "channel opened for receiving by both peers", dirRecv,
+			chName, 0)
+	}
+}
+
+// mismatched returns the openWait of the local net-chan chName, if it is pending while
+// the peer opened chName with the same direction and without the opposite one.
+func (m *Session) mismatched(chName string) (send, recv *openWait) {
+	sci := m.sendMn.info(chName)
+	rci := m.recvMn.info(chName)
+	if sci.isOpenLocal && !sci.isOpenRemote && rci.isOpenRemote && !rci.isOpenLocal &&
+		rci.peerDirs == openedSend {
+		send = sci.wait
+	}
+	if rci.isOpenLocal && !rci.isOpenRemote && sci.isOpenRemote && !sci.isOpenLocal &&
+		!sci.isClosing && sci.peerDirs == openedRecv {
+		recv = rci.wait
+	}
+	return
+}
@@ -0,0 +1,106 @@
+package netchan
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrClosedByPeer is the error of a net-chan opened for sending, after the peer closed
+// it (see NetChan.Close and Session.CloseRecv). The values sent after that are
+// discarded.
+var ErrClosedByPeer = errors.New("netchan: net-chan closed by peer")
+
+// A NetChan is a handle to a net-chan opened locally, returned by OpenSendChan and
+// OpenRecvChan. It can be used to follow the life of the net-chan and to close it. All
+// its methods can be called safely from multiple goroutines.
+type NetChan struct {
+	ssn   *Session
+	name  string
+	wait  *openWait
+	stats *chanStats
+	buf   *buffer     // nil for net-chans opened for sending
+	acks  *ackTracker // nil for net-chans opened for receiving or not reliable
+}
+
+// ChanStats holds statistics on a net-chan, see NetChan.Stats.
+type ChanStats struct {
+	// Items is the number of values sent to the peer or received from it.
+	Items int64
+
+	// Batches is the number of batches in which the values have been grouped.
+	Batches int64
+
+	// Pending is the number of values that are in flight. For a net-chan opened for
+	// sending, these are the values that the peer has not consumed yet (they are on
+	// the connection or in the buffer of the peer). For a net-chan opened for receiving,
+	// these are the values in the local buffer, not delivered to the user yet. If the
+	// net-chan has been opened with OpenRecvBytes, Pending counts bytes instead.
+	Pending int64
+}
+
+type chanStats struct {
+	items, batches, pending int64
+}
+
+func (s *chanStats) addBatch(batchLen int) {
+	atomic.AddInt64(&s.items, int64(batchLen))
+	atomic.AddInt64(&s.batches, 1)
+}
+
+// Name returns the name of the net-chan.
+func (c *NetChan) Name() string {
+	return c.name
+}
+
+// Ready returns a channel that is closed when the peer opens the net-chan. If the open
+// fails or is canceled, the channel is never closed.
+func (c *NetChan) Ready() <-chan struct{} {
+	return c.wait.ready
+}
+
+// Done returns a channel that is closed when the net-chan stops working: because it
+// has been closed, by either peer, because of an error or because the session shut
+// down.
+func (c *NetChan) Done() <-chan struct{} {
+	return c.wait.done
+}
+
+// Err returns the error that made the net-chan fail. It returns nil while the net-chan
+// is working and after it has been closed without errors. If the session shuts down
+// before the net-chan is closed, Err returns the error of the session.
+func (c *NetChan) Err() error {
+	if err := c.wait.error(); err != nil {
+		return err
+	}
+	if c.wait.isClosed() {
+		return nil
+	}
+	return c.ssn.Err()
+}
+
+// Stats returns statistics on the traffic of the net-chan.
+func (c *NetChan) Stats() ChanStats {
+	st := c.stats.snapshot()
+	if c.buf != nil {
+		st.Pending = atomic.LoadInt64(&c.buf.len)
+	}
+	return st
+}
+
+// Close closes the net-chan. If the net-chan has been opened for receiving, the peer
+// is told to stop sending; the values already in flight are discarded and then the
+// channel passed to OpenRecvChan is closed; on the peer, the net-chan fails with
+// ErrClosedByPeer. If the net-chan has been opened for sending, the values that have
+// not been taken from the channel passed to OpenSendChan yet are not sent (closing that
+// channel is the way to close a net-chan after all its values have been delivered). In
+// both cases, Err will return nil. Close returns an error if the net-chan has already
+// been closed or has failed.
+func (c *NetChan) Close() error {
+	if !c.wait.close() {
+		if err := c.wait.error(); err != nil {
+			return err
+		}
+		return errNetChanClosed
+	}
+	return nil
+}
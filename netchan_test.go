@@ -1,10 +1,21 @@
 package netchan_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -81,6 +92,24 @@ func intConsumer(t *testing.T, mn *netchan.Session, chName string) <-chan []int
 	return sliceCh
 }
 
+// chansOpen returns the number of net-chans of a session that are open or half open.
+func chansOpen(mn *netchan.Session) int {
+	st := mn.Stats()
+	return st.OpenChans + st.HalfOpenChans
+}
+
+// waitFor polls cond until it is true, and fails the test if that takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 // checks that s[i] == i for each i
 func checkIntSlice(t *testing.T, s []int) {
 	for i, si := range s {
@@ -212,3 +241,1560 @@ func sliceConsumer(t *testing.T, conn io.ReadWriteCloser) {
 		}
 	}
 }
+
+// OpenSendContext and OpenRecvContext fail when the peer does not open the net-chan in
+// time, without compromising the session.
+func TestOpenContext(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	ctx, cancel := context.WithCancel(context.Background())
+	mnA := netchan.NewSessionContext(ctx, sideA)
+	mnB := netchan.NewSession(sideB)
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err := mnA.OpenRecvContext(timeout, "nobody sends", make(chan int, 1), 10)
+	cancelTimeout()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ch := make(chan int, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mnB.OpenSendContext(context.Background(), "integers", ch)
+	}()
+	recvCh := make(chan int, 1)
+	err = mnA.OpenRecvContext(context.Background(), "integers", recvCh, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	ch <- 42
+	if i := <-recvCh; i != 42 {
+		t.Fatalf("expected 42, got %d", i)
+	}
+
+	cancel()
+	<-mnA.Done()
+	if err := mnA.Err(); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written concurrently.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+type countMetrics struct {
+	flushes, sent, received int64
+}
+
+func (m *countMetrics) Flushed(bytes int) { atomic.AddInt64(&m.flushes, 1) }
+
+func (m *countMetrics) BatchSent(chName string, batchLen int) {
+	atomic.AddInt64(&m.sent, int64(batchLen))
+}
+
+func (m *countMetrics) BatchReceived(chName string, batchLen int) {
+	atomic.AddInt64(&m.received, int64(batchLen))
+}
+
+func TestSessionOptions(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	_, err := netchan.NewSessionWithOptions(sideA,
+		&netchan.SessionOptions{MsgSizeLimit: 100})
+	if err == nil {
+		t.Fatal("expected error for too small MsgSizeLimit")
+	}
+	_, err = netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{MaxHalfOpen: -1})
+	if err == nil {
+		t.Fatal("expected error for negative MaxHalfOpen")
+	}
+	_, err = netchan.NewSessionWithOptions(sideA,
+		&netchan.SessionOptions{MaxBufferedBytes: -1})
+	if err == nil {
+		t.Fatal("expected error for negative MaxBufferedBytes")
+	}
+
+	var logBuf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logBuf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	metrics := new(countMetrics)
+	opts := &netchan.SessionOptions{
+		BatchSize:       64,
+		InitialBatchLen: 1,
+		InternalChanCap: 2,
+		Logger:          logger,
+		Metrics:         metrics,
+	}
+	mnA, err := netchan.NewSessionWithOptions(sideA, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB, err := netchan.NewSessionWithOptions(sideB,
+		&netchan.SessionOptions{Metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intProducer(t, mnA, "integers", 500)
+	checkIntSlice(t, <-intConsumer(t, mnB, "integers"))
+	mnA.Quit()
+	<-mnB.Done()
+
+	if sent := atomic.LoadInt64(&metrics.sent); sent != 500 {
+		t.Errorf("metrics counted %d items sent, expected 500", sent)
+	}
+	if received := atomic.LoadInt64(&metrics.received); received != 500 {
+		t.Errorf("metrics counted %d items received, expected 500", received)
+	}
+	if atomic.LoadInt64(&metrics.flushes) == 0 {
+		t.Error("metrics counted no flushes")
+	}
+	if !strings.Contains(logBuf.String(), "integers") {
+		t.Errorf("logger did not receive the open of net-chan integers, got:\n%s",
+			logBuf.String())
+	}
+}
+
+// both peers open the same net-chans with the same direction
+func TestDirMismatch(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+	ctx := context.Background()
+
+	errCh := make(chan error, 4)
+	for _, mn := range []*netchan.Session{mnA, mnB} {
+		mn := mn
+		go func() {
+			errCh <- mn.OpenSendContext(ctx, "foo", make(chan int))
+		}()
+		go func() {
+			errCh <- mn.OpenRecvContext(ctx, "bar", make(chan int), 10)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errCh; err != netchan.ErrDirMismatch {
+			t.Fatalf("expected ErrDirMismatch, got %v", err)
+		}
+	}
+
+	// the session is still usable, also the names of the failed net-chans
+	waitFor(t, "the failed net-chans to be closed", func() bool {
+		return chansOpen(mnA) == 0 && chansOpen(mnB) == 0
+	})
+	intProducer(t, mnA, "foo", 100)
+	s := <-intConsumer(t, mnB, "foo")
+	if len(s) != 100 {
+		t.Fatalf("expected 100 integers, got %d", len(s))
+	}
+	checkIntSlice(t, s)
+
+	// a name used in both directions, opened in opposite orders, is not a mismatch
+	if err := mnA.OpenSend("baz", make(chan int)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnA.OpenRecv("baz", make(chan int), 10); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := mnB.OpenRecvContext(ctx, "baz", make(chan int), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnB.OpenSendContext(ctx, "baz", make(chan int)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+	ctx := context.Background()
+
+	// both peers are waiting when the types are checked
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- mnA.OpenSendContext(ctx, "foo", make(chan int))
+	}()
+	go func() {
+		errCh <- mnB.OpenRecvContext(ctx, "foo", make(chan string), 10)
+	}()
+	for i := 0; i < 2; i++ {
+		err := <-errCh
+		if err == nil || !strings.Contains(err.Error(), "type mismatch") {
+			t.Fatalf("expected type mismatch error, got %v", err)
+		}
+	}
+
+	// the sender announced its type before the receiver opens the net-chan
+	waitFor(t, "the failed net-chans to be closed", func() bool {
+		return chansOpen(mnA) == 0 && chansOpen(mnB) == 0
+	})
+	if err := mnA.OpenSend("bar", make(chan int)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the open of the sender", func() bool { return chansOpen(mnB) == 1 })
+	err := mnB.OpenRecv("bar", make(chan string), 10)
+	if err == nil || !strings.Contains(err.Error(), "type mismatch") {
+		t.Fatalf("expected type mismatch error, got %v", err)
+	}
+
+	// the session is still usable
+	intProducer(t, mnA, "integers", 100)
+	checkIntSlice(t, <-intConsumer(t, mnB, "integers"))
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A batch that can not be decoded makes only its net-chan fail.
+func TestChanReset(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+
+	// gob can't decode 1000 as an int8
+	sendCh := make(chan int64, 1)
+	if err := mnA.OpenSend("bytes", sendCh); err != nil {
+		t.Fatal(err)
+	}
+	recvCh := make(chan int8, 1)
+	if err := mnB.OpenRecv("bytes", recvCh, 10); err != nil {
+		t.Fatal(err)
+	}
+	sendCh <- 1000
+	if i, ok := <-recvCh; ok {
+		t.Fatalf("expected closed channel, got %d", i)
+	}
+	if err := mnB.RecvErr("bytes"); err == nil {
+		t.Fatal("expected error on the receiving net-chan")
+	}
+	for i := 0; mnA.SendErr("bytes") == nil; i++ {
+		if i == 100 {
+			t.Fatal("expected error on the sending net-chan")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// values sent after the reset are discarded
+	for i := 0; i < 10; i++ {
+		sendCh <- int64(i)
+	}
+	close(sendCh)
+
+	intProducer(t, mnA, "integers", 100)
+	checkIntSlice(t, <-intConsumer(t, mnB, "integers"))
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetChan(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+
+	sendCh := make(chan int, 10)
+	sendNc, err := mnA.OpenSendChan("integers", sendCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvCh := make(chan int, 10)
+	recvNc, err := mnB.OpenRecvChan("integers", recvCh, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sendNc.Ready()
+	<-recvNc.Ready()
+	go func() {
+		for i := 0; i < 100; i++ {
+			sendCh <- i
+		}
+		close(sendCh)
+	}()
+	var s []int
+	for i := range recvCh {
+		s = append(s, i)
+	}
+	checkIntSlice(t, s)
+	<-sendNc.Done()
+	<-recvNc.Done()
+	for _, nc := range []*netchan.NetChan{sendNc, recvNc} {
+		if err := nc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if st := nc.Stats(); st.Items != 100 || st.Batches == 0 {
+			t.Fatalf("%s: unexpected stats %+v", nc.Name(), st)
+		}
+	}
+
+	// close on the receiving side
+	sendCh = make(chan int)
+	sendNc, err = mnA.OpenSendChan("stream", sendCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case sendCh <- i:
+			case <-sendNc.Done():
+				return
+			}
+		}
+	}()
+	recvCh = make(chan int, 10)
+	recvNc, err = mnB.OpenRecvChan("stream", recvCh, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if j := <-recvCh; j != i {
+			t.Fatalf("expected %d, got %d", i, j)
+		}
+	}
+	if err := recvNc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range recvCh {
+	}
+	<-sendNc.Done()
+	<-recvNc.Done()
+	if err := recvNc.Close(); err == nil {
+		t.Fatal("net-chan closed twice")
+	}
+	if err := recvNc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendNc.Err(); err != netchan.ErrClosedByPeer {
+		t.Fatalf("expected ErrClosedByPeer, got %v", err)
+	}
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The receiver closes the net-chan, the sender is not blocked.
+func TestCloseRecv(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+
+	sendCh := make(chan int)
+	if err := mnA.OpenSend("integers", sendCh); err != nil {
+		t.Fatal(err)
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			sendCh <- i
+			if err := mnA.SendErr("integers"); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+	}()
+	recvCh := make(chan int, 10)
+	if err := mnB.OpenRecv("integers", recvCh, 20); err != nil {
+		t.Fatal(err)
+	}
+	checkIntSlice(t, []int{<-recvCh, <-recvCh, <-recvCh})
+	if err := mnB.CloseRecv("integers"); err != nil {
+		t.Fatal(err)
+	}
+	for range recvCh {
+	}
+	if err := <-sendErr; err != netchan.ErrClosedByPeer {
+		t.Fatalf("expected ErrClosedByPeer, got %v", err)
+	}
+	if err := mnB.RecvErr("integers"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnB.CloseRecv("integers"); err == nil {
+		t.Fatal("net-chan closed twice")
+	}
+
+	// a net-chan stops even if the user is not receiving its values
+	sendCh = make(chan int)
+	if err := mnA.OpenSend("stuck", sendCh); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 10; i++ {
+			sendCh <- i
+		}
+	}()
+	nc, err := mnB.OpenRecvChan("stuck", make(chan int, 1), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the values of the stuck net-chan", func() bool {
+		return mnB.Stats().Recv["stuck"].Items >= 2
+	})
+	if err := nc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-nc.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the net-chan did not stop")
+	}
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Net-chans with the same name are opened and closed repeatedly, by the sender and by
+// the receiver.
+func TestReuseName(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+	const n = 50
+
+	go func() {
+		for k := 0; k < n; k++ {
+			ch := make(chan int, 1)
+			nc, err := mnA.OpenSendChan("response", ch)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ch <- k
+			close(ch)
+			<-nc.Done()
+		}
+	}()
+	for k := 0; k < n; k++ {
+		ch := make(chan int, 1)
+		if err := mnB.OpenRecv("response", ch, 1); err != nil {
+			t.Fatal(err)
+		}
+		if i := <-ch; i != k {
+			t.Fatalf("expected %d, got %d", k, i)
+		}
+		if _, ok := <-ch; ok {
+			t.Fatal("expected closed channel")
+		}
+	}
+
+	go func() {
+		for k := 0; k < n; k++ {
+			ch := make(chan int)
+			nc, err := mnA.OpenSendChan("stream", ch)
+			if err != nil {
+				log.Fatal(err)
+			}
+		Send:
+			for i := k * 1000; ; i++ {
+				select {
+				case ch <- i:
+				case <-nc.Done():
+					break Send
+				}
+			}
+			if err := nc.Err(); err != netchan.ErrClosedByPeer {
+				log.Fatalf("expected ErrClosedByPeer, got %v", err)
+			}
+		}
+	}()
+	for k := 0; k < n; k++ {
+		ch := make(chan int, 10)
+		nc, err := mnB.OpenRecvChan("stream", ch, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := <-ch; i != k*1000 {
+			t.Fatalf("expected %d, got %d", k*1000, i)
+		}
+		nc.Close()
+		for range ch {
+		}
+	}
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+	const n = 1000
+
+	go func() {
+		ch := make(chan int, 15)
+		if err := mnA.OpenSend("foo", ch); err != nil {
+			log.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			ch <- i
+		}
+		close(ch)
+	}()
+	sliceCh := make(chan []int)
+	go func() {
+		// a slow consumer, that does not give up when the session shuts down
+		var slice []int
+		ch := make(chan int, 8)
+		if err := mnB.OpenRecv("foo", ch, 60); err != nil {
+			log.Fatal(err)
+		}
+		for i := range ch {
+			if i%100 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			slice = append(slice, i)
+		}
+		sliceCh <- slice
+	}()
+	time.Sleep(20 * time.Millisecond) // let the net-chan open
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := mnA.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnA.Err(); err != netchan.EndOfSession {
+		t.Fatalf("expected EndOfSession, got %v", err)
+	}
+	<-mnB.Done()
+	if err := mnB.Err(); err != netchan.EndOfSession {
+		t.Fatalf("expected EndOfSession, got %v", err)
+	}
+	slice := <-sliceCh
+	if len(slice) != n {
+		t.Fatalf("expected %d values, got %d", n, len(slice))
+	}
+	checkIntSlice(t, slice)
+
+	// a net-chan that is never closed makes Shutdown expire
+	sideA, sideB = newPipeConn()
+	mnA = netchan.NewSession(sideA)
+	mnB = netchan.NewSession(sideB)
+	ch := make(chan int)
+	if err := mnA.OpenSend("bar", ch); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := mnA.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := mnA.OpenRecv("baz", make(chan int, 1), 1); err != netchan.ErrShuttingDown {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
+
+func TestSessionStats(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+
+	sendCh := make(chan int)
+	sendNc, err := mnA.OpenSendChan("integers", sendCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvCh := make(chan int, 5)
+	if err := mnB.OpenRecv("integers", recvCh, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnB.OpenRecv("half-open", make(chan int, 1), 1); err != nil {
+		t.Fatal(err)
+	}
+	<-sendNc.Ready()
+	go func() {
+		for i := 0; i < 100; i++ {
+			sendCh <- i
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		<-recvCh
+	}
+	time.Sleep(20 * time.Millisecond) // let the credits arrive
+
+	stA, stB := mnA.Stats(), mnB.Stats()
+	if stA.Send["integers"].Items != 100 || stB.Recv["integers"].Items != 100 {
+		t.Fatalf("unexpected per-channel stats: %+v, %+v", stA.Send, stB.Recv)
+	}
+	if stA.CreditStalls == 0 {
+		t.Fatal("expected credit stalls, the receive buffer is smaller than the data")
+	}
+	var batches int64
+	for _, n := range stA.BatchLens {
+		batches += n
+	}
+	if batches != stA.Send["integers"].Batches {
+		t.Fatalf("BatchLens %v does not add up to %d batches", stA.BatchLens,
+			stA.Send["integers"].Batches)
+	}
+	if stA.BytesSent == 0 || stA.MsgsSent == 0 || stA.Flushes == 0 {
+		t.Fatalf("unexpected stats: %+v", stA)
+	}
+	// the peer received everything that has been flushed, and nothing else
+	if stB.BytesReceived != stA.BytesSent || stB.MsgsReceived != stA.MsgsSent {
+		t.Fatalf("sent %d bytes in %d messages, received %d bytes in %d messages",
+			stA.BytesSent, stA.MsgsSent, stB.BytesReceived, stB.MsgsReceived)
+	}
+	if stA.OpenChans != 1 || stA.HalfOpenChans != 1 {
+		t.Fatalf("expected 1 open and 1 half-open net-chan, got %d and %d",
+			stA.OpenChans, stA.HalfOpenChans)
+	}
+	if stB.OpenChans != 1 || stB.HalfOpenChans != 1 {
+		t.Fatalf("expected 1 open and 1 half-open net-chan, got %d and %d",
+			stB.OpenChans, stB.HalfOpenChans)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var logBuf syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&logBuf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	sideA, sideB := newPipeConn()
+	mnA, err := netchan.NewSessionWithOptions(sideA,
+		&netchan.SessionOptions{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB := netchan.NewSession(sideB)
+	intProducer(t, mnA, "integers", 100)
+	checkIntSlice(t, <-intConsumer(t, mnB, "integers"))
+	mnB.Quit()
+	<-mnA.Done()
+	time.Sleep(20 * time.Millisecond) // let the session log its end
+
+	type record struct {
+		Level, Msg, Chan, Dir string
+		Session               int64
+		ChanId                int `json:"chan_id"`
+	}
+	var opened, closed, shutDown bool
+	dec := json.NewDecoder(strings.NewReader(logBuf.String()))
+	for dec.More() {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Session == 0 {
+			t.Errorf("record without session id: %+v", r)
+		}
+		switch r.Msg {
+		case "channel opened":
+			opened = r.Chan == "integers" && r.Dir == "send" && r.ChanId != 0 &&
+				r.Level == "DEBUG"
+		case "channel closed":
+			closed = r.Chan == "integers" && r.Dir == "send"
+		case "session shut down":
+			shutDown = r.Level == "INFO"
+		}
+	}
+	if !opened || !closed || !shutDown {
+		t.Errorf("missing or wrong records (opened %v, closed %v, shut down %v):\n%s",
+			opened, closed, shutDown, logBuf.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	recA, recB := netchan.NewTraceRecorder(1000), netchan.NewTraceRecorder(1000)
+	sideA, sideB := newPipeConn()
+	mnA, _ := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{Tracer: recA})
+	mnB, _ := netchan.NewSessionWithOptions(sideB, &netchan.SessionOptions{Tracer: recB})
+	intProducer(t, mnA, "integers", 100)
+	checkIntSlice(t, <-intConsumer(t, mnB, "integers"))
+	time.Sleep(20 * time.Millisecond) // let the last messages arrive
+
+	// the messages of the sender, and those of the receiver
+	senderMsgs := []string{"hello", "initData", "data", "close"}
+	receiverMsgs := []string{"hello", "initCredit", "credit", "closeAck"}
+	for _, side := range []struct {
+		mn         *netchan.Session
+		rec        *netchan.TraceRecorder
+		sent, recv []string
+	}{
+		{mnA, recA, senderMsgs, receiverMsgs},
+		{mnB, recB, receiverMsgs, senderMsgs},
+	} {
+		count := make(map[string]int)
+		var items int
+		var size int64
+		for _, ev := range side.rec.Events() {
+			if ev.Size <= 0 {
+				t.Errorf("event with no size: %s", ev)
+			}
+			count[fmt.Sprint(ev.Sent, ev.Type)]++
+			if ev.Sent {
+				size += int64(ev.Size)
+			}
+			items += ev.BatchLen
+		}
+		for _, typ := range side.sent {
+			if count[fmt.Sprint(true, typ)] == 0 {
+				t.Errorf("no sent %s event", typ)
+			}
+		}
+		for _, typ := range side.recv {
+			if count[fmt.Sprint(false, typ)] == 0 {
+				t.Errorf("no received %s event", typ)
+			}
+		}
+		if items != 100 {
+			t.Errorf("data events carry %d values, expected 100", items)
+		}
+		if st := side.mn.Stats(); size != st.BytesSent {
+			t.Errorf("the events sent add up to %d bytes, stats say %d", size,
+				st.BytesSent)
+		}
+	}
+
+	// the ring buffer keeps the last events
+	rec := netchan.NewTraceRecorder(3)
+	for i := 1; i <= 5; i++ {
+		rec.Trace(netchan.TraceEvent{ChId: i})
+	}
+	if evs := rec.Events(); len(evs) != 3 || evs[0].ChId != 3 || evs[2].ChId != 5 {
+		t.Errorf("unexpected events %v", evs)
+	}
+
+	// the events are dumped when a session fails
+	var dump syncBuffer
+	recA.DumpOnError(mnA, &dump)
+	mnB.QuitWith(errors.New("test error"))
+	<-mnA.Done()
+	time.Sleep(20 * time.Millisecond)
+	if s := dump.String(); !strings.Contains(s, "test error") ||
+		!strings.Contains(s, "recv error") {
+		t.Errorf("unexpected dump:\n%s", s)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	// an idle session stays up, thanks to the pongs of the peer
+	sideA, sideB := newPipeConn()
+	mnA, err := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		PingInterval: 10 * time.Millisecond, IdleTimeout: 60 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB := netchan.NewSession(sideB)
+	time.Sleep(200 * time.Millisecond)
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mnA.Stats().MsgsReceived; n < 5 {
+		t.Fatalf("expected some pongs, got %d messages", n)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+
+	// a peer that does not answer
+	sideA, sideB = newPipeConn()
+	go io.Copy(ioutil.Discard, sideB)
+	mnA, _ = netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		PingInterval: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond})
+	select {
+	case <-mnA.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not time out")
+	}
+	if err := mnA.Err(); err != netchan.ErrPeerTimeout {
+		t.Fatalf("expected ErrPeerTimeout, got %v", err)
+	}
+}
+
+// delayConn delays each write
+type delayConn struct {
+	pipeConn
+	delay time.Duration
+}
+
+func (c delayConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.pipeConn.Write(p)
+}
+
+func TestRTT(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	sideA, sideB := newPipeConn()
+	mnA, _ := netchan.NewSessionWithOptions(delayConn{sideA, delay},
+		&netchan.SessionOptions{PingInterval: 20 * time.Millisecond})
+	mnB := netchan.NewSession(delayConn{sideB, delay})
+	time.Sleep(300 * time.Millisecond)
+
+	// the ping and the pong are delayed once each
+	if rtt := mnA.RTT(); rtt < 2*delay || rtt > time.Second {
+		t.Errorf("unexpected RTT %s", rtt)
+	}
+	if srtt := mnA.SmoothedRTT(); srtt < 2*delay || srtt > time.Second {
+		t.Errorf("unexpected smoothed RTT %s", srtt)
+	}
+	if rtt := mnB.RTT(); rtt != 0 {
+		t.Errorf("RTT measured without pings: %s", rtt)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
+
+// resumeDialer connects two resumable sessions with pipes; breakConn breaks the last
+// connection.
+type resumeDialer struct {
+	mu     sync.Mutex
+	last   pipeConn
+	dials  int
+	accept chan pipeConn
+}
+
+func (d *resumeDialer) dial() (io.ReadWriteCloser, error) {
+	sideA, sideB := newPipeConn()
+	d.mu.Lock()
+	d.last = sideA
+	d.dials++
+	d.mu.Unlock()
+	d.accept <- sideB
+	return sideA, nil
+}
+
+func (d *resumeDialer) acceptConn() (io.ReadWriteCloser, error) {
+	return <-d.accept, nil
+}
+
+func (d *resumeDialer) breakConn() {
+	d.mu.Lock()
+	d.last.Close()
+	d.mu.Unlock()
+}
+
+func TestResumableSession(t *testing.T) {
+	d := &resumeDialer{accept: make(chan pipeConn)}
+	opts := &netchan.ResumeOptions{MinBackoff: time.Millisecond, Window: 64}
+	rsA := netchan.NewResumableSession(d.dial, opts)
+	rsB := netchan.NewResumableSession(d.acceptConn, opts)
+
+	const n = 5000
+	go func() {
+		ch := make(chan int, 15)
+		if err := rsA.OpenSend("integers", ch); err != nil {
+			log.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			ch <- i
+		}
+		close(ch)
+	}()
+	ch := make(chan int, 8)
+	if err := rsB.OpenRecv("integers", ch, 60); err != nil {
+		t.Fatal(err)
+	}
+	var s []int
+	for i := range ch {
+		s = append(s, i)
+		if len(s)%1000 == 0 && len(s) < n {
+			d.breakConn()
+		}
+	}
+	if len(s) != n {
+		t.Fatalf("received %d values, want %d", len(s), n)
+	}
+	checkIntSlice(t, s)
+	d.mu.Lock()
+	if d.dials < 2 {
+		t.Errorf("%d connections, expected reconnections", d.dials)
+	}
+	d.mu.Unlock()
+
+	// the name can be reused, when the sender knows that all the values were delivered
+	ch = make(chan int, 8)
+	if err := rsB.OpenRecv("integers", ch, 60); err != nil {
+		t.Fatal(err)
+	}
+	sendCh := make(chan int)
+	deadline := time.Now().Add(5 * time.Second)
+	for rsA.OpenSend("integers", sendCh) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the name of the finished net-chan can not be reused")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		for i := 0; i < 100; i++ {
+			sendCh <- i
+		}
+		close(sendCh)
+	}()
+	s = s[:0]
+	for i := range ch {
+		s = append(s, i)
+	}
+	if len(s) != 100 {
+		t.Fatalf("received %d values on the reused name, want 100", len(s))
+	}
+	checkIntSlice(t, s)
+
+	if err := rsB.OpenRecv(netchan.ResumeChanName, make(chan int, 1), 1); err == nil {
+		t.Error("the reserved name has been accepted")
+	}
+	rsA.Quit()
+	<-rsB.Done()
+	if err := rsB.Err(); err != netchan.EndOfSession {
+		t.Errorf("got error %v, want EndOfSession", err)
+	}
+	if err := rsA.Err(); err != netchan.ErrResumableClosed {
+		t.Errorf("got error %v, want ErrResumableClosed", err)
+	}
+}
+
+func TestReliable(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA, err := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{Reliable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB := netchan.NewSession(sideB)
+
+	// the receiver stops reading, then the session ends
+	sendCh := make(chan int)
+	nc, err := mnA.OpenSendChan("integers", sendCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var taken int32
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case sendCh <- i:
+				atomic.AddInt32(&taken, 1)
+			case <-mnA.Done():
+				return
+			}
+		}
+	}()
+	recvCh := make(chan int, 1)
+	if err := mnB.OpenRecv("integers", recvCh, 20); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		<-recvCh
+	}
+	time.Sleep(100 * time.Millisecond)
+	mnA.Quit()
+	<-mnB.Done()
+	delivered := 10 + len(recvCh)
+	unacked := nc.Unacked().([]int)
+	if len(unacked) == 0 {
+		t.Fatal("no unacknowledged values")
+	}
+	if unacked[0] > delivered {
+		t.Errorf("value %d has been delivered, but it is not reported", delivered)
+	}
+	for i, v := range unacked {
+		if v != unacked[0]+i {
+			t.Fatalf("unacknowledged values not contiguous: %v", unacked)
+		}
+	}
+	if last := unacked[len(unacked)-1]; last != int(atomic.LoadInt32(&taken))-1 {
+		t.Errorf("last unacknowledged value is %d, %d values sent", last, taken)
+	}
+
+	// all the values are delivered
+	sideC, sideD := newPipeConn()
+	mnC, _ := netchan.NewSessionWithOptions(sideC, &netchan.SessionOptions{Reliable: true})
+	mnD := netchan.NewSession(sideD)
+	sendCh2 := make(chan int, 10)
+	nc2, err := mnC.OpenSendChan("integers", sendCh2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 1000; i++ {
+			sendCh2 <- i
+		}
+		close(sendCh2)
+	}()
+	s := <-intConsumer(t, mnD, "integers")
+	checkIntSlice(t, s)
+	if err := mnC.Shutdown(context.Background()); err != nil && err != netchan.EndOfSession {
+		t.Fatal(err)
+	}
+	if unacked := nc2.Unacked().([]int); len(unacked) != 0 {
+		t.Errorf("%d values not acknowledged", len(unacked))
+	}
+	if mnD.Stats().MsgsSent < 10 {
+		t.Error("expected acknowledgments")
+	}
+
+	// not reliable
+	sideE, _ := newPipeConn()
+	mnE := netchan.NewSession(sideE)
+	nc3, _ := mnE.OpenSendChan("integers", make(chan int))
+	if nc3.Unacked() != nil {
+		t.Error("Unacked works without the Reliable option")
+	}
+	mnE.QuitWith(nil)
+}
+
+func TestServer(t *testing.T) {
+	srv := netchan.NewServer(func(ssn *netchan.Session) {
+		intProducer(t, ssn, "integers", 500)
+	}, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+
+	const clients = 5
+	var sessions []*netchan.Session
+	var sliceChans []<-chan []int
+	for i := 0; i < clients; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ssn := netchan.NewSession(conn)
+		sessions = append(sessions, ssn)
+		sliceChans = append(sliceChans, intConsumer(t, ssn, "integers"))
+	}
+	for _, ch := range sliceChans {
+		s := <-ch
+		if len(s) != 500 {
+			t.Fatalf("expected 500 integers, got %d", len(s))
+		}
+		checkIntSlice(t, s)
+	}
+	if n := len(srv.Sessions()); n != clients {
+		t.Errorf("%d live sessions, expected %d", n, clients)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; err != netchan.ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	for _, ssn := range sessions {
+		<-ssn.Done()
+		if err := ssn.Err(); err != netchan.EndOfSession {
+			t.Errorf("client session ended with %v", err)
+		}
+	}
+	if n := len(srv.Sessions()); n != 0 {
+		t.Errorf("%d live sessions after shutdown", n)
+	}
+	if err := srv.ListenAndServe("tcp", "127.0.0.1:0"); err != netchan.ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v after shutdown", err)
+	}
+}
+
+// flakyListener fails the first Accept calls with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary accept error" }
+func (tempError) Temporary() bool { return true }
+func (tempError) Timeout() bool   { return false }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, tempError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeTemporaryError(t *testing.T) {
+	srv := netchan.NewServer(func(ssn *netchan.Session) {
+		intProducer(t, ssn, "integers", 100)
+	}, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(&flakyListener{ln, 3}) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssn := netchan.NewSession(conn)
+	if s := <-intConsumer(t, ssn, "integers"); len(s) != 100 {
+		t.Errorf("expected 100 integers, got %d", len(s))
+	}
+	ssn.Quit()
+	srv.Close()
+	if err := <-serveErr; err != netchan.ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	srv := netchan.NewServer(func(ssn *netchan.Session) {
+		if id := ssn.Peer().Identity; id != "client" {
+			log.Fatalf("peer identity is %q", id)
+		}
+	}, &netchan.SessionOptions{Identity: "server"})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ssn, err := netchan.Dial(ctx, "tcp", ln.Addr().String(),
+		&netchan.SessionOptions{Identity: "client", Reliable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := ssn.Peer()
+	if peer.Identity != "server" || peer.Version != netchan.ProtocolVersion ||
+		peer.Features&netchan.FeatureAcks == 0 {
+		t.Errorf("unexpected peer info %+v", peer)
+	}
+	ssn.Quit()
+
+	// an endpoint that does not speak netchan
+	mute, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mute.Close()
+	go func() {
+		conn, err := mute.Accept()
+		if err == nil {
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = netchan.Dial(ctx, "tcp", mute.Addr().String(), nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want DeadlineExceeded", err)
+	}
+
+	// the same, with HandshakeTimeout
+	sideA, sideB := newPipeConn()
+	go io.Copy(ioutil.Discard, sideB)
+	mn, _ := netchan.NewSessionWithOptions(sideA,
+		&netchan.SessionOptions{HandshakeTimeout: 50 * time.Millisecond})
+	if err := mn.Handshake(context.Background()); err != netchan.ErrHandshakeTimeout {
+		t.Errorf("got error %v, want ErrHandshakeTimeout", err)
+	}
+}
+
+func TestIncompatiblePeer(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	go io.Copy(ioutil.Discard, sideB)
+	// a hello message of a future version of the protocol
+	type hello struct {
+		Type, Version int
+	}
+	go gob.NewEncoder(sideB).Encode(hello{0, netchan.ProtocolVersion + 1})
+	mn := netchan.NewSession(sideA)
+	err := mn.Handshake(context.Background())
+	if !errors.Is(err, netchan.ErrIncompatiblePeer) {
+		t.Fatalf("got error %v, want ErrIncompatiblePeer", err)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	var requests int32
+	mnA, err := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		Authorizer: func(req netchan.OpenRequest) error {
+			atomic.AddInt32(&requests, 1)
+			if strings.HasPrefix(req.Name, "secret") {
+				return errors.New("access denied")
+			}
+			if req.ElemType != "int" {
+				return fmt.Errorf("unexpected element type %s", req.ElemType)
+			}
+			return nil
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB := netchan.NewSession(sideB)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the peer opens first, for sending and for receiving
+	err = mnB.OpenSendContext(ctx, "secret-send", make(chan int))
+	if !errors.Is(err, netchan.ErrRejected) || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("got error %v, want a rejection", err)
+	}
+	err = mnB.OpenRecvContext(ctx, "secret-recv", make(chan int, 1), 1)
+	if !errors.Is(err, netchan.ErrRejected) {
+		t.Errorf("got error %v, want a rejection", err)
+	}
+
+	// the net-chans are open locally
+	ncA, err := mnA.OpenRecvChan("secret-recv2", make(chan int, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the open of the peer succeeds, then the net-chan fails
+	ncB, err := mnB.OpenSendChan("secret-recv2", make(chan int))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ncB.Done()
+	if err := ncB.Err(); !errors.Is(err, netchan.ErrRejected) {
+		t.Errorf("got error %v, want a rejection", err)
+	}
+	<-ncA.Done()
+	if err := ncA.Err(); !errors.Is(err, netchan.ErrRejected) {
+		t.Errorf("got error %v on the local net-chan, want a rejection", err)
+	}
+	ncA, err = mnA.OpenSendChan("secret-send2", make(chan int))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ncB, err = mnB.OpenRecvChan("secret-send2", make(chan int, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ncB.Done()
+	if err := ncB.Err(); !errors.Is(err, netchan.ErrRejected) {
+		t.Errorf("got error %v, want a rejection", err)
+	}
+	<-ncA.Done()
+	if err := ncA.Err(); !errors.Is(err, netchan.ErrRejected) {
+		t.Errorf("got error %v on the local net-chan, want a rejection", err)
+	}
+
+	// the name can be opened again locally, and allowed net-chans work
+	if err := mnA.OpenRecv("secret-send", make(chan int, 1), 1); err != nil {
+		t.Fatal(err)
+	}
+	intProducer(t, mnB, "integers", 100)
+	checkIntSlice(t, <-intConsumer(t, mnA, "integers"))
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Errorf("the authorizer has been called %d times, expected 5", n)
+	}
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnB.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
+
+func TestAuthorizeTimeout(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	block := make(chan struct{})
+	defer close(block)
+	mnA, err := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		AuthorizeTimeout: 50 * time.Millisecond,
+		Authorizer: func(req netchan.OpenRequest) error {
+			if req.Name == "slow" {
+				<-block
+			}
+			return nil
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB := netchan.NewSession(sideB)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = mnB.OpenSendContext(ctx, "slow", make(chan int))
+	if !errors.Is(err, netchan.ErrRejected) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got error %v, want a rejection", err)
+	}
+	intProducer(t, mnB, "integers", 100)
+	checkIntSlice(t, <-intConsumer(t, mnA, "integers"))
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
+
+func TestQuotas(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA, err := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		MaxOpenChans: 2, MaxBufferedItems: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB := netchan.NewSession(sideB)
+	if err := mnA.OpenRecv("a", make(chan int), 5); err != nil {
+		t.Fatal(err)
+	}
+	err = mnA.OpenRecv("b", make(chan int), 6)
+	if !errors.Is(err, netchan.ErrQuotaExceeded) {
+		t.Errorf("got error %v, want ErrQuotaExceeded for MaxBufferedItems", err)
+	}
+	ncC, err := mnA.OpenSendChan("c", make(chan int))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mnA.OpenSend("d", make(chan int))
+	if !errors.Is(err, netchan.ErrQuotaExceeded) {
+		t.Errorf("got error %v, want ErrQuotaExceeded for MaxOpenChans", err)
+	}
+	// the slot of c is released when the peer acknowledges its close
+	if err := ncC.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = mnA.OpenSend("d", make(chan int))
+		if !errors.Is(err, netchan.ErrQuotaExceeded) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+
+	// a batch that exceeds MaxBufferedBytes makes only its net-chan fail
+	sideA, sideB = newPipeConn()
+	mnA, err = netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		MaxBufferedBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB = netchan.NewSession(sideB)
+	// nobody receives: at most one batch leaves the buffer
+	ncA, err := mnA.OpenRecvChan("bytes", make(chan []byte), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytesCh := make(chan []byte)
+	ncB, err := mnB.OpenSendChan("bytes", bytesCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		bytesCh <- make([]byte, 400)
+	}
+	<-ncA.Done()
+	if err := ncA.Err(); !errors.Is(err, netchan.ErrQuotaExceeded) {
+		t.Errorf("got error %v, want ErrQuotaExceeded for MaxBufferedBytes", err)
+	}
+	<-ncB.Done()
+	if ncB.Err() == nil {
+		t.Error("the net-chan did not fail on the sending side")
+	}
+	intProducer(t, mnB, "integers", 100)
+	checkIntSlice(t, <-intConsumer(t, mnA, "integers"))
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
+
+func TestByteCredits(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA := netchan.NewSession(sideA)
+	mnB := netchan.NewSession(sideB)
+	if _, err := mnA.OpenRecvBytes("blobs", make(chan []byte), 10); err == nil {
+		t.Error("OpenRecvBytes accepted a budget smaller than a batch")
+	}
+	const budget, n, size = 4096, 100, 1000
+	recvCh := make(chan []byte)
+	ncA, err := mnA.OpenRecvBytes("blobs", recvCh, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendCh := make(chan []byte)
+	if err := mnB.OpenSend("blobs", sendCh); err != nil {
+		t.Fatal(err)
+	}
+	var sent int32
+	go func() {
+		for i := 0; i < n; i++ {
+			blob := bytes.Repeat([]byte{byte(i)}, size)
+			select {
+			case sendCh <- blob:
+				atomic.AddInt32(&sent, 1)
+			case <-mnB.Done():
+				return
+			}
+		}
+		close(sendCh)
+	}()
+
+	// nobody receives: the sender stops when the budget is exhausted
+	time.Sleep(100 * time.Millisecond)
+	if s := atomic.LoadInt32(&sent); s > budget/size+5 {
+		t.Errorf("%d values sent with a budget of %d bytes", s, budget)
+	}
+	if p := ncA.Stats().Pending; p == 0 || p > budget+2*size {
+		t.Errorf("%d bytes pending in the buffer, budget is %d", p, budget)
+	}
+	for i := 0; i < n; i++ {
+		blob := <-recvCh
+		if len(blob) != size || blob[0] != byte(i) || blob[size-1] != byte(i) {
+			t.Fatalf("value %d is wrong", i)
+		}
+	}
+	if _, ok := <-recvCh; ok {
+		t.Error("the channel has not been closed")
+	}
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
+
+// A value taken from the channel of the user while the window is exhausted is reported
+// by Unacked when the session ends.
+func TestConnWindowUnacked(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	mnA, err := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		Reliable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB, err := netchan.NewSessionWithOptions(sideB, &netchan.SessionOptions{
+		ConnWindow: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody receives, so the window fills up
+	if _, err := mnB.OpenRecvChan("integers", make(chan int), 100); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan int)
+	nc, err := mnA.OpenSendChan("integers", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := 0
+Loop:
+	for ; sent < 100; sent++ {
+		select {
+		case ch <- sent:
+		case <-time.After(100 * time.Millisecond):
+			break Loop // the sender is blocked on the window
+		}
+	}
+	if sent == 100 {
+		t.Fatal("the window did not block the sender")
+	}
+	mnA.Quit()
+	<-mnB.Done()
+	<-nc.Done()
+	unacked := nc.Unacked().([]int)
+	if len(unacked) != sent {
+		t.Errorf("%d values unacked, want %d", len(unacked), sent)
+	}
+	checkIntSlice(t, unacked)
+}
+
+func TestConnWindow(t *testing.T) {
+	sideA, sideB := newPipeConn()
+	const window, chans, n = 50, 10, 200
+	mnA, err := netchan.NewSessionWithOptions(sideA, &netchan.SessionOptions{
+		ConnWindow: window})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnB := netchan.NewSession(sideB)
+	var recvChans [chans]chan int
+	var netChans [chans]*netchan.NetChan
+	var sendChans [chans]chan int
+	for i := range recvChans {
+		name := "integers" + strconv.Itoa(i)
+		recvChans[i] = make(chan int)
+		netChans[i], err = mnA.OpenRecvChan(name, recvChans[i], n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendChans[i] = make(chan int, n)
+		nc, err := mnB.OpenSendChan(name, sendChans[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-nc.Ready()
+	}
+	// all the net-chans are open, so none can take more than its share of the window
+	for _, ch := range sendChans {
+		for j := 0; j < n; j++ {
+			ch <- j
+		}
+		close(ch)
+	}
+
+	// nobody receives: the buffers hold window values, shared by the net-chans
+	waitFor(t, "the window to fill up", func() bool {
+		var pending int64
+		for _, nc := range netChans {
+			pending += nc.Stats().Pending
+		}
+		if pending > window {
+			t.Fatalf("%d values in the buffers, the window is %d", pending, window)
+		}
+		return pending == window
+	})
+	for i, nc := range netChans {
+		if p := nc.Stats().Pending; p != window/chans {
+			t.Errorf("net-chan %d holds %d values of the window, want %d", i, p,
+				window/chans)
+		}
+	}
+	// values not received hold the window, so all the net-chans are drained together
+	var wg sync.WaitGroup
+	for i, ch := range recvChans {
+		wg.Add(1)
+		go func(i int, ch chan int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if v := <-ch; v != j {
+					t.Errorf("net-chan %d: got %d, want %d", i, v, j)
+					return
+				}
+			}
+		}(i, ch)
+	}
+	wg.Wait()
+	if err := mnA.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if mnB.Peer().Features&netchan.FeatureConnWindow == 0 {
+		t.Error("FeatureConnWindow not announced")
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
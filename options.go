@@ -0,0 +1,232 @@
+package netchan
+
+import (
+	"log/slog"
+	"time"
+)
+
+// SessionOptions tunes the behavior of a session, see NewSessionWithOptions. The zero
+// value of each field selects the default.
+type SessionOptions struct {
+	// MsgSizeLimit is the maximum size of the messages that will be accepted from the
+	// connection. When a too big message is received, an error is signaled on the
+	// session and the session shuts down. It must be at least 512 bytes; the default
+	// is 16KB.
+	MsgSizeLimit int
+
+	// Codec is used to serialize messages; the default is GobCodec.
+	Codec Codec
+
+	// InternalChanCap is the capacity of the Go channels that connect the goroutines
+	// of the session. The default is 8.
+	InternalChanCap int
+
+	// BatchSize is the desired size in bytes of an encoded batch. The values sent on
+	// a net-chan are grouped in batches, whose length is adjusted so that their
+	// encoded size approaches BatchSize. The default is 4096.
+	BatchSize int
+
+	// InitialBatchLen is the length of the first batches sent on a net-chan, before
+	// the size of its encoded items is known. The default is 10.
+	InitialBatchLen int
+
+	// MaxHalfOpen is the maximum number of net-chans that the peer can open without a
+	// local counterpart, for each direction. When the limit is exceeded, the session
+	// shuts down with an error. The default is 256.
+	MaxHalfOpen int
+
+	// MaxNameLen is the maximum length of a net-chan name. The default is 500.
+	MaxNameLen int
+
+	// MaxOpenChans is the maximum number of net-chans that can be open locally at the
+	// same time, in both directions. A net-chan counts until its close handshake is
+	// complete, that is until its name can be used again. An open that exceeds the
+	// limit fails with an error that wraps ErrQuotaExceeded. The default, 0, means no
+	// limit.
+	MaxOpenChans int
+
+	// MaxBufferedItems is the maximum sum of the buffer capacities of the net-chans
+	// open locally for receiving (see OpenRecv). An open that exceeds the limit fails
+	// with an error that wraps ErrQuotaExceeded. The default, 0, means no limit.
+	MaxBufferedItems int
+
+	// MaxBufferedBytes is the maximum number of bytes that the values received and not
+	// yet delivered to the user can take, on all the net-chans; the size of the values
+	// is estimated with their encoded size. When a batch exceeds the limit, its
+	// net-chan fails with an error that wraps ErrQuotaExceeded and the peer is
+	// notified; the session is not affected. The default, 0, means no limit.
+	MaxBufferedBytes int
+
+	// ConnWindow is the maximum number of values that the peer can send on all the
+	// net-chans together, before they leave the receive buffers; it bounds the values
+	// in the buffers, however many net-chans are open. A batch gives back its part of
+	// the window when it is taken out of the buffer to be delivered to the user, so
+	// each net-chan can also hold the batch that it is delivering. The window is
+	// announced to the peer in the hello message, and each net-chan of the peer can
+	// use an equal share of it. The values left in the buffers hold the window, so all
+	// the net-chans should be drained. When the peer exceeds the window, the session
+	// shuts down with an error. The default, 0, means no limit.
+	ConnWindow int
+
+	// QuitTimeout is how long Quit waits for the termination message to be sent to the
+	// peer before closing the connection anyway. The default is 1 second.
+	QuitTimeout time.Duration
+
+	// PingInterval is how often the session sends a ping to the peer, which answers
+	// with a pong; pings also measure the round-trip time (see Session.RTT). The
+	// default, 0, disables pings.
+	PingInterval time.Duration
+
+	// IdleTimeout is how long the session waits for messages from the peer (pings,
+	// pongs or anything else). If nothing arrives for IdleTimeout, the session shuts
+	// down with ErrPeerTimeout: that is how a dead connection is detected. Pings make
+	// sure that a healthy, idle connection carries some traffic, so IdleTimeout should
+	// be a few times PingInterval (of either peer). The default, 0, disables the
+	// timeout.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout is how long the session waits for the hello message of the
+	// peer, which is the first message on the connection. If it does not arrive in
+	// time, the session shuts down with ErrHandshakeTimeout. The default, 0, disables
+	// the timeout, except for the sessions of a Server (see NewServer).
+	HandshakeTimeout time.Duration
+
+	// Identity is sent to the peer in the hello message, see Session.Peer. It is not
+	// interpreted by netchan.
+	Identity string
+
+	// Authorizer, if not nil, is called when the peer opens a net-chan, before the
+	// net-chan is used. If it returns an error, the open is rejected: the net-chan
+	// fails on both peers with an error that wraps ErrRejected and reports the error
+	// of the Authorizer. If the net-chan was open locally already, the open of the
+	// peer may succeed before the rejection reaches it. The session does not process
+	// other messages from the peer while it waits for the Authorizer, so the Authorizer
+	// should be fast; if it does not return within AuthorizeTimeout, the open is
+	// rejected.
+	Authorizer func(req OpenRequest) error
+
+	// AuthorizeTimeout is how long the session waits for the Authorizer. The default
+	// is 1 second.
+	AuthorizeTimeout time.Duration
+
+	// Reliable enables the acknowledgment of the values sent: the peer acknowledges
+	// each batch after delivering its values, and the values that have not been
+	// acknowledged when the session ends can be retrieved with NetChan.Unacked, to be
+	// sent again (at-least-once delivery). The values are kept in memory until they
+	// are acknowledged. Only the sending peer needs this option.
+	Reliable bool
+
+	// Logger, if not nil, receives the events of the session (open and close of
+	// net-chans, shutdown) as structured records. Each record has the id of the session
+	// as attribute LogKeySession; records about a single net-chan also have the
+	// attributes LogKeyChan, LogKeyChanId and LogKeyDir. Open and close events are
+	// logged at level Debug, the start and the end of the session at level Info and
+	// errors at level Warn. If Logger is nil, the events are logged only if netchan is
+	// built with the nchdebug tag.
+	Logger *slog.Logger
+
+	// Metrics, if not nil, is notified of the traffic of the session.
+	Metrics Metrics
+
+	// Tracer, if not nil, is notified of every protocol message sent or received. See
+	// TraceRecorder for a tracer that keeps the last messages, to be examined when
+	// something goes wrong.
+	Tracer Tracer
+}
+
+// Metrics is a hook for collecting statistics on the traffic of a session. The methods
+// are called synchronously by the goroutines of the session, so they must be fast and
+// safe for concurrent use.
+type Metrics interface {
+	// Flushed is called every time the session flushes the connection, with the number
+	// of bytes that have been written since the previous flush.
+	Flushed(bytes int)
+
+	// BatchSent is called every time a batch of batchLen items is sent on the
+	// net-chan chName.
+	BatchSent(chName string, batchLen int)
+
+	// BatchReceived is called every time a batch of batchLen items arrives on the
+	// net-chan chName.
+	BatchReceived(chName string, batchLen int)
+}
+
+const (
+	minMsgSizeLimit    = 512
+	defMsgSizeLimit    = 16 * 1024
+	defInternalChanCap = 8
+	defBatchSize       = 4096
+	defInitialBatchLen = 10
+	defMaxHalfOpen     = 256
+	defMaxNameLen      = 500
+	defQuitTimeout     = 1 * time.Second
+	defAuthTimeout     = 1 * time.Second
+
+	defServerHandshakeTimeout = 10 * time.Second // see NewServer
+)
+
+// setDefaults checks the options and replaces zero values with the defaults.
+func (o *SessionOptions) setDefaults() error {
+	switch {
+	case o.MsgSizeLimit < 0:
+		return fmtErr("negative MsgSizeLimit")
+	case o.MsgSizeLimit == 0:
+		o.MsgSizeLimit = defMsgSizeLimit
+	case o.MsgSizeLimit < minMsgSizeLimit:
+		return fmtErr("MsgSizeLimit must be at least %d", minMsgSizeLimit)
+	}
+	if o.Codec == nil {
+		o.Codec = GobCodec{}
+	}
+	ints := [...]struct {
+		pt   *int
+		def  int
+		name string
+	}{
+		{&o.InternalChanCap, defInternalChanCap, "InternalChanCap"},
+		{&o.BatchSize, defBatchSize, "BatchSize"},
+		{&o.InitialBatchLen, defInitialBatchLen, "InitialBatchLen"},
+		{&o.MaxHalfOpen, defMaxHalfOpen, "MaxHalfOpen"},
+		{&o.MaxNameLen, defMaxNameLen, "MaxNameLen"},
+	}
+	for _, i := range ints {
+		if *i.pt < 0 {
+			return fmtErr("negative %s", i.name)
+		}
+		if *i.pt == 0 {
+			*i.pt = i.def
+		}
+	}
+	switch {
+	case o.MaxOpenChans < 0:
+		return fmtErr("negative MaxOpenChans")
+	case o.MaxBufferedItems < 0:
+		return fmtErr("negative MaxBufferedItems")
+	case o.MaxBufferedBytes < 0:
+		return fmtErr("negative MaxBufferedBytes")
+	case o.ConnWindow < 0:
+		return fmtErr("negative ConnWindow")
+	}
+	if o.QuitTimeout < 0 {
+		return fmtErr("negative QuitTimeout")
+	}
+	if o.QuitTimeout == 0 {
+		o.QuitTimeout = defQuitTimeout
+	}
+	if o.PingInterval < 0 {
+		return fmtErr("negative PingInterval")
+	}
+	if o.IdleTimeout < 0 {
+		return fmtErr("negative IdleTimeout")
+	}
+	if o.HandshakeTimeout < 0 {
+		return fmtErr("negative HandshakeTimeout")
+	}
+	if o.AuthorizeTimeout < 0 {
+		return fmtErr("negative AuthorizeTimeout")
+	}
+	if o.AuthorizeTimeout == 0 {
+		o.AuthorizeTimeout = defAuthTimeout
+	}
+	return nil
+}
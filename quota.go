@@ -0,0 +1,90 @@
+package netchan
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrQuotaExceeded is wrapped by the errors caused by the resource limits of a session:
+// SessionOptions.MaxOpenChans, MaxBufferedItems and MaxBufferedBytes.
+var ErrQuotaExceeded = errors.New("netchan: quota exceeded")
+
+/*
+The quotas of a session count the resources held by the net-chans opened locally:
+
+- a net-chan holds a slot of MaxOpenChans from the open until the close handshake is
+  complete, when its name can be reused: the sendManager releases it when the close is
+  acknowledged, the recvManager when it sends the acknowledgment;
+
+- a net-chan open for receiving also holds its buffer capacity (MaxBufferedItems) for
+  the same time;
+
+- each batch in a receive buffer holds its encoded size (MaxBufferedBytes) from when
+  the recvManager puts it in the buffer until the recvProxy takes it out. That is only
+  an estimate of the memory used by the decoded values, but it grows with it.
+
+The net-chans opened only by the peer are limited by MaxHalfOpen instead.
+*/
+
+// quotas holds the resources in use, updated atomically.
+type quotas struct {
+	chans, items, bytes int64
+}
+
+// reserve adds n to *used, unless the result exceeds max (if max is not 0). It returns
+// false if the reservation did not take place.
+func reserve(used *int64, n int64, max int) bool {
+	if max <= 0 {
+		atomic.AddInt64(used, n)
+		return true
+	}
+	// A failed reservation must not be visible, even for a moment, to the concurrent
+	// ones, which could fail because of it.
+	for {
+		cur := atomic.LoadInt64(used)
+		if cur+n > int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(used, cur, cur+n) {
+			return true
+		}
+	}
+}
+
+// reserveChan reserves the resources of a net-chan opened locally; bufCap is 0 for a
+// net-chan opened for sending.
+func (m *Session) reserveChan(chName string, bufCap int) error {
+	if !reserve(&m.quotas.chans, 1, m.opts.MaxOpenChans) {
+		return fmt.Errorf("%w: can not open %s, %d net-chans are open already "+
+			"(MaxOpenChans)", ErrQuotaExceeded, chName, m.opts.MaxOpenChans)
+	}
+	if !reserve(&m.quotas.items, int64(bufCap), m.opts.MaxBufferedItems) {
+		atomic.AddInt64(&m.quotas.chans, -1)
+		return fmt.Errorf("%w: can not open %s with buffer capacity %d, the buffers "+
+			"of the open net-chans can hold %d items at most (MaxBufferedItems)",
+			ErrQuotaExceeded, chName, bufCap, m.opts.MaxBufferedItems)
+	}
+	return nil
+}
+
+// releaseChan releases the resources reserved by reserveChan.
+func (m *Session) releaseChan(bufCap int) {
+	atomic.AddInt64(&m.quotas.chans, -1)
+	atomic.AddInt64(&m.quotas.items, -int64(bufCap))
+}
+
+// reserveBytes reserves the memory of a received batch of the net-chan chName.
+func (m *Session) reserveBytes(chName string, size int) error {
+	if !reserve(&m.quotas.bytes, int64(size), m.opts.MaxBufferedBytes) {
+		return fmt.Errorf("%w: batch of %d bytes received on %s, the receive buffers "+
+			"can hold %d bytes at most (MaxBufferedBytes)", ErrQuotaExceeded, size,
+			chName, m.opts.MaxBufferedBytes)
+	}
+	return nil
+}
+
+// releaseBytes releases the memory of a batch taken out of a receive buffer.
+func (m *Session) releaseBytes(size int) {
+	atomic.AddInt64(&m.quotas.bytes, -int64(size))
+}
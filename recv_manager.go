@@ -1,72 +1,170 @@
 package netchan
 
 import (
+	"context"
+	"log/slog"
 	"reflect"
 	"sync"
 	"sync/atomic"
 )
 
 type buffer struct {
-	cap, len int64 // number of items, not number of batches
+	cap, len   int64 // number of items, not number of batches
+	byteCredit bool  // cap and len are in bytes, see bytecredit.go
 
-	// ch holds batches of items.
+	// The queue of batches grows as they arrive, so the memory that it takes depends on
+	// the batches in the buffer, not on its capacity (a net-chan opened with
+	// OpenRecvBytes can hold a lot of small batches).
 	// Keeping batches as interface{} instead of reflect.Values saves some memory.
-	ch      chan interface{}
-	ssnDone <-chan struct{}
-	chName  string
+	mu     sync.Mutex
+	queue  []seqBatch
+	head   int           // index of the first batch in queue
+	closed bool          // no more batches will be put
+	notify chan struct{} // signaled when a batch is put or the buffer is closed
+	ssn    *Session
+	chName string
+	stats  chanStats
 }
 
-func newBuffer(cap int, ssnDone <-chan struct{}, chName string) *buffer {
-	// The buffer must be able to hold cap items, we only store batches with non-zero
-	// length, so allocating memory for cap batches is sufficient and sometimes more than
-	// necessary; a smarter implementation could save some memory by allocating lazily.
-	return &buffer{int64(cap), 0, make(chan interface{}, cap), ssnDone, chName}
+func newBuffer(cap int, ssn *Session, chName string, byteCredit bool) *buffer {
+	return &buffer{cap: int64(cap), byteCredit: byteCredit,
+		notify: make(chan struct{}, 1), ssn: ssn, chName: chName}
 }
 
-func (b *buffer) put(batch reflect.Value) error {
+// amount returns the credit taken by a batch of batchLen items, whose message is size
+// bytes long.
+func (b *buffer) amount(batchLen, size int) int64 {
+	if b.byteCredit {
+		return int64(batchCost(size))
+	}
+	return int64(batchLen)
+}
+
+// itemCap returns the capacity of the buffer in items, 0 if it is measured in bytes.
+func (b *buffer) itemCap() int {
+	if b.byteCredit {
+		return 0
+	}
+	return int(b.cap)
+}
+
+// put adds a batch to the buffer; seq is its sequence number, 0 if the sender is not
+// reliable, and size is the encoded size of its message.
+func (b *buffer) put(batch reflect.Value, seq uint64, size int) error {
 	if batch.Len() == 0 {
 		return nil
 	}
-	length := atomic.AddInt64(&b.len, int64(batch.Len()))
-	if length > b.cap {
+	amount := b.amount(batch.Len(), size)
+	limit := b.cap
+	if b.byteCredit {
+		limit += 2 * int64(b.ssn.opts.MsgSizeLimit)
+	}
+	length := atomic.AddInt64(&b.len, amount)
+	if length > limit {
 		return fmtErr("peer sent more than its credit allowed")
 	}
-	select {
-	case b.ch <- batch.Interface():
-		return nil
-	default:
-		panic("impossible")
+	if err := b.ssn.reserveBytes(b.chName, size); err != nil {
+		atomic.AddInt64(&b.len, -amount)
+		return err
+	}
+	b.mu.Lock()
+	if b.head > 0 && len(b.queue) == cap(b.queue) {
+		// reuse the space of the batches taken out, instead of growing
+		n := copy(b.queue, b.queue[b.head:])
+		for i := n; i < len(b.queue); i++ {
+			b.queue[i] = seqBatch{}
+		}
+		b.queue, b.head = b.queue[:n], 0
 	}
+	b.queue = append(b.queue, seqBatch{batch.Interface(), seq, size})
+	b.mu.Unlock()
+	b.signal()
+	return nil
 }
 
-func (b *buffer) get() (batch reflect.Value, ok, done bool) {
-	var batchE interface{}
+func (b *buffer) signal() {
 	select {
-	case batchE, ok = <-b.ch:
-		if !ok {
+	case b.notify <- struct{}{}:
+	default: // the receiver has not seen the previous signal yet
+	}
+}
+
+// pop takes the first batch out of the queue. ok is false if the queue is empty.
+func (b *buffer) pop() (sb seqBatch, ok, closed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.head == len(b.queue) {
+		return sb, false, b.closed
+	}
+	sb = b.queue[b.head]
+	b.queue[b.head] = seqBatch{}
+	b.head++
+	if b.head == len(b.queue) {
+		b.queue, b.head = b.queue[:0], 0
+	}
+	return sb, true, b.closed
+}
+
+// get returns the next batch from the buffer, with its sequence number and the credit
+// that it took. ok is false if the buffer has been closed. done is true if the session
+// is done or cancel is closed.
+func (b *buffer) get(cancel <-chan struct{}) (batch reflect.Value, seq uint64,
+	amount int, ok, done bool) {
+	for {
+		select {
+		case <-b.ssn.Done():
+			done = true
+			return
+		case <-cancel:
+			done = true
 			return
+		default:
+		}
+		sb, present, closed := b.pop()
+		if present {
+			batch, seq = reflect.ValueOf(sb.batch), sb.seq
+			amount = int(b.amount(batch.Len(), sb.size))
+			atomic.AddInt64(&b.len, -int64(amount))
+			b.ssn.releaseBytes(sb.size)
+			return batch, seq, amount, true, false
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-b.notify:
+		case <-b.ssn.Done():
+		case <-cancel:
 		}
-		batch = reflect.ValueOf(batchE)
-		atomic.AddInt64(&b.len, -int64(batch.Len()))
-		return
-	case <-b.ssnDone:
-		done = true
-		return
 	}
 }
 
-func (b *buffer) close() { close(b.ch) }
+// close marks the end of the batches; get returns the ones in the queue first.
+func (b *buffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.signal()
+}
 
 type rChanInfo struct {
 	isOpenLocal  bool
 	isOpenRemote bool
+	rejected     bool  // the open of the peer has been rejected, see authorize.go
+	peerDirs     uint8 // announced by the open of the peer, see mismatch.go
 	id           int
+	wait         *openWait
+	freed        chan struct{} // closed when the close has been acknowledged
 }
 
 type recvTable struct {
 	sync.Mutex
 	buffer map[int]*buffer
 	chInfo map[string]rChanInfo
+	// Net-chans that have been closed, but whose close has not been acknowledged yet.
+	// They are removed from chInfo right away, but a new net-chan with the same name
+	// can not be opened locally until they are removed from here too.
+	closing map[string]chan struct{}
 }
 
 type recvProxy struct {
@@ -76,19 +174,24 @@ type recvProxy struct {
 	buf       *buffer
 	dataCh    reflect.Value // chan<- T
 	toEncoder chan<- credit
+	wait      *openWait
 }
 
-func (r *recvProxy) sendToUser(val reflect.Value) {
+// sendToUser returns false if val has not been delivered, because the session is done
+// or the net-chan stopped.
+func (r *recvProxy) sendToUser(val reflect.Value) bool {
 	ok := r.dataCh.TrySend(val)
 	if ok {
-		return
+		return true
 	}
 	// Slow path.
 	sendOrDone := [...]reflect.SelectCase{
 		{Dir: reflect.SelectSend, Chan: r.dataCh, Send: val},
 		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.ssn.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.wait.canceled)},
 	}
-	reflect.Select(sendOrDone[:])
+	i, _, _ := reflect.Select(sendOrDone[:])
+	return i == 0
 }
 
 func (r *recvProxy) sendToEncoder(cred credit) {
@@ -99,20 +202,67 @@ func (r *recvProxy) sendToEncoder(cred credit) {
 }
 
 func (r *recvProxy) run() {
-	r.sendToEncoder(credit{header{initCreditMsg, r.chId, r.chName}, int(r.buf.cap)})
+	defer r.wait.finish()
+	initCred := header{Type: initCreditMsg, ChId: r.chId, ChName: r.chName,
+		ByteCredit: r.buf.byteCredit, Dirs: r.ssn.openDirs(r.chName)}
+	batchType := reflect.SliceOf(r.dataCh.Type().Elem())
+	initCred.setTypeInfo(newTypeInfo(batchType, r.ssn.opts.Codec))
+	r.sendToEncoder(credit{initCred, int(r.buf.cap)})
+	cancel := r.wait.canceled
 	for {
-		batch, ok, done := r.buf.get()
+		batch, seq, amount, ok, done := r.buf.get(cancel)
 		if done {
-			return
+			if cancel == nil || !r.wait.isStopped() {
+				return // session done
+			}
+			// Tell the sender to stop. The batches already in flight will be
+			// discarded, until the close message arrives.
+			cancel = nil
+			cancelH := header{Type: cancelMsg, ChId: r.chId, ChName: r.chName}
+			switch {
+			case r.wait.isClosed():
+				cancelH.Err = "closed by receiver"
+			case r.wait.isFailed():
+				cancelH.Type = resetMsg
+				cancelH.Err = r.wait.err.Error()
+			default:
+				cancelH.Err = r.wait.err.Error()
+				if reason, ok := localRejection(r.wait.err); ok {
+					cancelH.Type = rejectMsg
+					cancelH.Err = reason
+				}
+			}
+			r.sendToEncoder(credit{header: cancelH})
+			continue
 		}
 		if !ok {
-			r.dataCh.Close()
+			r.wait.close()
+			// if the open was canceled, the user does not expect anything on dataCh
+			if !r.wait.isCanceled() {
+				r.dataCh.Close()
+			}
 			return
 		}
+		r.ssn.returnWindow(batch.Len())
+		if r.wait.isStopped() {
+			continue
+		}
 		batchLen := batch.Len()
-		r.sendToEncoder(credit{header{creditMsg, r.chId, ""}, batchLen})
-		for i := 0; i < batchLen; i++ {
-			r.sendToUser(batch.Index(i))
+		r.sendToEncoder(credit{header{Type: creditMsg, ChId: r.chId}, amount})
+		delivered := true
+		for i := 0; i < batchLen && delivered; i++ {
+			// Stop at the first value not delivered, so that the user always
+			// receives a prefix of what has been sent.
+			delivered = r.sendToUser(batch.Index(i))
+		}
+		if !delivered {
+			if !r.wait.isStopped() {
+				return // session done
+			}
+			continue // the rest of the batch is discarded
+		}
+		if seq != 0 {
+			r.sendToEncoder(credit{header: header{Type: ackMsg, ChId: r.chId, Seq: seq}})
 		}
 	}
 }
@@ -124,94 +274,267 @@ type recvManager struct {
 	table     recvTable
 	newChId   int        // protected by table's mutex
 	types     *typeTable // decoder's
+	waits     waitTable
 }
 
-// Open a net-chan for receiving.
-func (r *recvManager) open(chName string, ch reflect.Value, bufCap int) error {
+// Open a net-chan for receiving; bufCap is in bytes if byteCredit is true. If the last
+// net-chan with the same name has been
+// canceled or closed locally, but the close handshake is not complete, open waits for
+// it, so that the peer can't mistake the messages of the two net-chans.
+func (r *recvManager) open(ctx context.Context, chName string, ch reflect.Value,
+	bufCap int, byteCredit bool) (*NetChan, error) {
 	r.table.Lock()
-	ci := r.table.chInfo[chName]
-	if ci.isOpenLocal {
+	var ci rChanInfo
+	for {
+		ci = r.table.chInfo[chName]
+		freed, closing := r.table.closing[chName]
+		if !closing && ci.rejected {
+			// wait for the peer to close it
+			freed, closing = ci.freed, true
+		}
+		if !closing && ci.isOpenLocal {
+			if !ci.wait.isStopped() {
+				r.table.Unlock()
+				return nil, fmtErr("channel %s is already open for receiving", chName)
+			}
+			freed, closing = ci.freed, true
+		}
+		if !closing {
+			break
+		}
+		r.table.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-r.ssn.Done():
+			return nil, r.ssn.Err()
+		}
+		r.table.Lock()
+	}
+	buf := newBuffer(bufCap, r.ssn, chName, byteCredit)
+	if err := r.ssn.reserveChan(chName, buf.itemCap()); err != nil {
 		r.table.Unlock()
-		return fmtErr("channel %s is already open for receiving", chName)
+		return nil, err
+	}
+	if ci.freed == nil {
+		ci.freed = make(chan struct{})
 	}
 	r.newChId++
 	ci.isOpenLocal = true
 	ci.id = r.newChId
+	ci.wait = newOpenWait()
+	// If the types do not match, the net-chan is opened anyway and canceled right
+	// away, so that the peer is notified.
+	typeErr := r.types.addLocal(chName, ci.id, reflect.SliceOf(ch.Type().Elem()))
+	if typeErr != nil {
+		ci.wait.cancel(typeErr)
+	} else if ci.isOpenRemote {
+		ci.wait.setReady()
+	}
 	r.table.chInfo[chName] = ci
-	buf := newBuffer(bufCap, r.ssn.Done(), chName)
+	r.waits.put(chName, ci.wait)
 	r.table.buffer[ci.id] = buf
-
-	r.types.Lock()
-	r.types.batchType[ci.id] = reflect.SliceOf(ch.Type().Elem())
-	r.types.Unlock()
-
 	r.table.Unlock()
 
-	go (&recvProxy{r.ssn, ci.id, chName, buf, ch, r.toEncoder}).run()
+	go (&recvProxy{r.ssn, ci.id, chName, buf, ch, r.toEncoder, ci.wait}).run()
+	if typeErr != nil {
+		r.ssn.logChan(slog.LevelWarn, "open failed", dirRecv, chName, ci.id,
+			slog.Any("error", typeErr))
+		return nil, typeErr
+	}
+	nc := &NetChan{ssn: r.ssn, name: chName, wait: ci.wait, stats: &buf.stats, buf: buf}
 	if ci.isOpenRemote {
-		logDebug("netchan session %d: channel %s opened as recv%d",
-			r.ssn.id, chName, ci.id)
-		return nil
+		r.ssn.logChan(slog.LevelDebug, "channel opened", dirRecv, chName, ci.id)
+		return nc, nil
 	}
-	logDebug("netchan session %d: opening channel %s for receiving", r.ssn.id, chName)
-	return nil
+	r.ssn.logChan(slog.LevelDebug, "opening channel", dirRecv, chName, ci.id)
+	r.ssn.checkDirections(chName)
+	return nc, nil
 }
 
 // Got an element from the decoder.
-func (r *recvManager) handleData(dat data) error {
+func (r *recvManager) handleData(dat data) {
 	r.table.Lock()
 	buf, present := r.table.buffer[dat.ChId]
 	r.table.Unlock()
 	if !present {
-		return fmtErr("data arrived for closed net-chan")
+		r.ssn.returnWindow(dat.BatchLen)
+		r.ssn.logChan(slog.LevelDebug, "data for closed channel discarded", dirRecv, "",
+			dat.ChId)
+		return
+	}
+	if dat.err != nil {
+		r.ssn.returnWindow(dat.BatchLen)
+		r.fail(dat.ChId, buf.chName, dat.err)
+		return
+	}
+	buf.stats.addBatch(dat.batch.Len())
+	atomic.AddInt64(&r.ssn.stats.itemsRecv, int64(dat.batch.Len()))
+	if r.ssn.opts.Metrics != nil {
+		r.ssn.opts.Metrics.BatchReceived(buf.chName, dat.batch.Len())
+	}
+	err := buf.put(dat.batch, dat.Seq, dat.size)
+	if err != nil {
+		r.ssn.returnWindow(dat.BatchLen)
+		r.fail(dat.ChId, buf.chName, err)
+	}
+}
+
+// fail resets a net-chan because of an error. The recvProxy discards the pending
+// batches and tells the sender to stop, the rest of the session is not affected.
+func (r *recvManager) fail(chId int, chName string, err error) {
+	r.types.discard(chId)
+	r.table.Lock()
+	ci := r.table.chInfo[chName]
+	r.table.Unlock()
+	if ci.id != chId || !ci.wait.fail(err) {
+		return
 	}
-	return buf.put(dat.batch)
+	r.ssn.logChan(slog.LevelWarn, "channel failed", dirRecv, chName, chId,
+		slog.Any("error", err))
 }
 
 func (r *recvManager) handleInitData(dat data) error {
 	r.table.Lock()
-	ci := r.table.chInfo[dat.ChName]
-	if ci.isOpenRemote {
-		r.table.Unlock()
+	openRemote := r.table.chInfo[dat.ChName].isOpenRemote
+	r.table.Unlock()
+	if openRemote {
 		return fmtErr("initial data received twice for the same channel")
 	}
+	// Only the recvManager sets isOpenRemote, so the check still holds after the
+	// Authorizer returns.
+	rejErr := r.ssn.authorize(dat.ChName, true, dat.ElemType)
+	r.table.Lock()
+	ci := r.table.chInfo[dat.ChName]
 	ci.isOpenRemote = true
+	ci.rejected = rejErr != nil
+	ci.peerDirs = dat.Dirs
+	if ci.freed == nil {
+		ci.freed = make(chan struct{})
+	}
+	if ci.isOpenLocal {
+		switch {
+		case rejErr != nil:
+			ci.wait.cancel(rejErr) // the recvProxy notifies the peer
+		case dat.err != nil:
+			ci.wait.cancel(dat.err)
+		default:
+			ci.wait.setReady()
+		}
+	}
 	r.table.chInfo[dat.ChName] = ci
 	halfOpen := len(r.table.chInfo) - len(r.table.buffer)
 	r.table.Unlock()
 
-	if ci.isOpenLocal {
-		logDebug("netchan session %d: channel %s opened as recv%d",
-			r.ssn.id, dat.ChName, ci.id)
+	if rejErr != nil {
+		r.ssn.logChan(slog.LevelWarn, "open rejected", dirRecv, dat.ChName, ci.id,
+			slog.Any("error", rejErr))
+		if !ci.isOpenLocal {
+			// As in handleClose, the recvManager must not send to the encoder.
+			reason, _ := localRejection(rejErr)
+			go r.sendToEncoder(credit{header: header{Type: rejectMsg, ChName: dat.ChName,
+				Err: reason}})
+		}
+	} else if dat.err != nil {
+		r.ssn.logChan(slog.LevelWarn, "open failed", dirRecv, dat.ChName, ci.id,
+			slog.Any("error", dat.err))
+	} else if ci.isOpenLocal {
+		r.ssn.logChan(slog.LevelDebug, "channel opened", dirRecv, dat.ChName, ci.id)
 	} else {
-		logDebug("netchan session %d: peer wants to send on channel %s",
-			r.ssn.id, dat.ChName)
+		r.ssn.logChan(slog.LevelDebug, "peer wants to send on channel", dirRecv,
+			dat.ChName, 0)
 	}
-	if halfOpen >= maxHalfOpen {
+	if halfOpen >= r.ssn.opts.MaxHalfOpen {
 		return fmtErr("too many half open channels")
 	}
+	if !ci.isOpenLocal && !ci.rejected {
+		r.ssn.checkDirections(dat.ChName)
+	}
 	return nil
 }
 
+func (r *recvManager) sendToEncoder(cred credit) {
+	select {
+	case r.toEncoder <- cred:
+	case <-r.ssn.Done():
+	}
+}
+
+// The close message identifies the net-chan by id or, if the sender closed it before
+// receiving the initial credit, by name. Either way, we acknowledge it, so that the
+// sender can forget about the net-chan.
 func (r *recvManager) handleClose(dat data) error {
 	r.table.Lock()
-	buf, present := r.table.buffer[dat.ChId]
-	if !present {
+	chName := dat.ChName
+	if dat.ChId != 0 {
+		buf, present := r.table.buffer[dat.ChId]
+		if !present {
+			r.table.Unlock()
+			return fmtErr("close message arrived for already closed channel")
+		}
+		chName = buf.chName
+	}
+	// If we canceled the net-chan, the peer may close it without having opened it.
+	ci, present := r.table.chInfo[chName]
+	if !present || !(ci.isOpenRemote || ci.isOpenLocal) {
 		r.table.Unlock()
-		return fmtErr("close message arrived for already closed channel")
+		return fmtErr("close message arrived for channel that was never opened")
 	}
-	delete(r.table.buffer, dat.ChId)
-	delete(r.table.chInfo, buf.chName)
-
-	r.types.Lock()
-	delete(r.types.batchType, dat.ChId)
-	r.types.Unlock()
-
+	buf := r.table.buffer[ci.id]
+	if dat.Err != "" && ci.isOpenLocal {
+		// the sender rejected the net-chan
+		rej := &rejection{chName: chName, reason: dat.Err}
+		if !ci.wait.cancel(rej) {
+			ci.wait.fail(rej)
+		}
+	}
+	if ci.isOpenLocal {
+		delete(r.table.buffer, ci.id)
+		r.waits.closed(chName, ci.wait)
+	}
+	r.types.remove(chName, ci.id)
+	delete(r.table.chInfo, chName)
+	r.table.closing[chName] = ci.freed
 	r.table.Unlock()
 
-	buf.close()
-	logDebug("netchan session %d: channel recv%d (%s) closed",
-		r.ssn.id, dat.ChId, buf.chName)
+	proxyDone := make(chan struct{})
+	close(proxyDone)
+	if buf != nil {
+		buf.close()
+		proxyDone = ci.wait.done
+	}
+	r.ssn.logChan(slog.LevelDebug, "channel closed", dirRecv, chName, ci.id)
+	// The recvManager must not send to the encoder (it would create a cycle in the
+	// graph of the goroutines), so the acknowledgment is sent by another goroutine.
+	// The ack is sent when the recvProxy, if any, has delivered all the values to the
+	// user: it follows the initial credit and, after receiving it, the peer knows that
+	// no value has been lost (see Session.Shutdown). It must also precede the messages
+	// of a new net-chan with the same name, because the peer can then reuse the name.
+	go func() {
+		select {
+		case <-proxyDone:
+		case <-r.ssn.Done():
+			return
+		}
+		select {
+		case r.toEncoder <- credit{header: header{Type: closeAckMsg, ChId: dat.ChId,
+			ChName: chName}}:
+		case <-r.ssn.Done():
+			return
+		}
+		if buf != nil {
+			r.ssn.releaseChan(buf.itemCap())
+		}
+		r.table.Lock()
+		// After the ack, the peer can open the name again and close it: the entry
+		// is then the one of the new net-chan.
+		if r.table.closing[chName] == ci.freed {
+			delete(r.table.closing, chName)
+		}
+		close(ci.freed)
+		r.table.Unlock()
+	}()
 	return nil
 }
 
@@ -220,7 +543,7 @@ func (r *recvManager) run() {
 		var err error
 		switch d.Type {
 		case dataMsg:
-			err = r.handleData(d)
+			r.handleData(d)
 		case initDataMsg:
 			err = r.handleInitData(d)
 		case closeMsg:
@@ -231,3 +554,60 @@ func (r *recvManager) run() {
 		}
 	}
 }
+
+// close closes a net-chan on behalf of the user, see Session.CloseRecv.
+func (r *recvManager) close(chName string) error {
+	r.table.Lock()
+	ci := r.table.chInfo[chName]
+	r.table.Unlock()
+	if !ci.isOpenLocal || !ci.wait.close() {
+		return fmtErr("channel %s is not open for receiving", chName)
+	}
+	r.ssn.logChan(slog.LevelDebug, "closing channel", dirRecv, chName, ci.id)
+	return nil
+}
+
+// busy returns the freed channel of a net-chan open locally for receiving that has been
+// opened by the peer too and has not been closed by it yet, or whose values are still
+// being delivered to the user. It returns nil if there is no such net-chan.
+func (r *recvManager) busy() <-chan struct{} {
+	r.table.Lock()
+	defer r.table.Unlock()
+	for _, freed := range r.table.closing {
+		return freed
+	}
+	for _, ci := range r.table.chInfo {
+		if ci.isOpenLocal && ci.isOpenRemote {
+			return ci.freed
+		}
+	}
+	return nil
+}
+
+// stats returns the statistics of the net-chans open locally, and counts the open and
+// half-open net-chans.
+func (r *recvManager) stats() (chans map[string]ChanStats, open, halfOpen int) {
+	chans = make(map[string]ChanStats)
+	r.table.Lock()
+	defer r.table.Unlock()
+	for chName, ci := range r.table.chInfo {
+		if buf := r.table.buffer[ci.id]; ci.isOpenLocal && buf != nil {
+			st := buf.stats.snapshot()
+			st.Pending = atomic.LoadInt64(&buf.len)
+			chans[chName] = st
+		}
+		if ci.isOpenLocal && ci.isOpenRemote {
+			open++
+		} else {
+			halfOpen++
+		}
+	}
+	return
+}
+
+// info returns the table entry of a net-chan.
+func (r *recvManager) info(chName string) rChanInfo {
+	r.table.Lock()
+	defer r.table.Unlock()
+	return r.table.chInfo[chName]
+}
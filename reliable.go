@@ -0,0 +1,105 @@
+package netchan
+
+import (
+	"reflect"
+	"sync"
+)
+
+/*
+In reliable mode (SessionOptions.Reliable), the sender numbers the batches of each
+net-chan with a sequence number, from 1, carried by the header of the data message. The
+receiver keeps the number with the batch in its buffer and, when the recvProxy has
+delivered all the values of the batch to the user, it sends an ackMsg with the same
+number. Batches are delivered in order, so an ack also covers the batches that precede
+it.
+
+The sender keeps the batches until they are acknowledged, in an ackTracker. Acks are
+handled by the sendManager, not by the sendProxy, because they can arrive after the
+sendProxy has closed the net-chan: the tracker stays in the sendTable until the peer
+acknowledges the close, which follows all the acks of the net-chan. What is left in the
+tracker when the session ends is what the peer may not have delivered.
+
+A receiver acks the batches that carry a sequence number, whatever its own options, so
+only the sender needs to be in reliable mode.
+*/
+
+// A batch with its sequence number; seq is 0 if the sender is not reliable.
+type seqBatch struct {
+	batch interface{}
+	seq   uint64
+	size  int // encoded size, for the receive buffers (see quota.go)
+}
+
+// ackTracker keeps the batches sent on a net-chan that have not been acknowledged yet.
+type ackTracker struct {
+	mu        sync.Mutex
+	batchType reflect.Type // []T
+	lastSeq   uint64
+	batches   []seqBatch // in order of sequence number
+}
+
+// add records a batch that is going to be sent and returns its sequence number.
+func (t *ackTracker) add(batch reflect.Value) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastSeq++
+	t.batches = append(t.batches, seqBatch{batch: batch.Interface(), seq: t.lastSeq})
+	return t.lastSeq
+}
+
+// ack forgets the batches up to seq, which the peer has delivered.
+func (t *ackTracker) ack(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for n < len(t.batches) && t.batches[n].seq <= seq {
+		t.batches[n] = seqBatch{}
+		n++
+	}
+	t.batches = t.batches[n:]
+}
+
+// unacked returns the values of the batches that have not been acknowledged, as a []T.
+func (t *ackTracker) unacked() interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	vals := reflect.MakeSlice(t.batchType, 0, 0)
+	for _, b := range t.batches {
+		vals = reflect.AppendSlice(vals, reflect.ValueOf(b.batch))
+	}
+	return vals.Interface()
+}
+
+// Unacked returns the values sent on the net-chan whose delivery has not been
+// acknowledged by the peer, in the order they were sent, as a slice whose element type
+// is the one of the net-chan. It is meant to be called after the session has shut down,
+// to send the values again on a new session: they may have been delivered, or not. If
+// the session has shut down, Unacked waits until the net-chan is done (see Done), so
+// that the last values taken from the channel of the user are reported too.
+//
+// A value counts as delivered when it has been sent to the channel passed to OpenRecv on
+// the peer, but acknowledgments cover whole batches, so some delivered values can be
+// reported too. Unacked returns nil if the session is not in reliable mode (see
+// SessionOptions.Reliable) or if the net-chan has been opened for receiving.
+func (c *NetChan) Unacked() interface{} {
+	if c.acks == nil {
+		return nil
+	}
+	select {
+	case <-c.ssn.Done():
+		// the sendProxy stops soon, after recording the values that it holds
+		<-c.wait.done
+	default:
+	}
+	return c.acks.unacked()
+}
+
+// An ack arrived.
+func (s *sendManager) handleAck(cred credit) {
+	s.table.Lock()
+	acks := s.table.acks[cred.ChId]
+	s.table.Unlock()
+	if acks != nil {
+		acks.ack(cred.Seq)
+	}
+}
@@ -0,0 +1,676 @@
+package netchan
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ResumeOptions tunes a ResumableSession, see NewResumableSession. The zero value of
+// each field selects the default.
+type ResumeOptions struct {
+	// Session holds the options of the sessions created on each connection; it can be
+	// nil.
+	Session *SessionOptions
+
+	// MinBackoff and MaxBackoff bound the time waited between two connection attempts,
+	// which doubles after each failure. The defaults are 100 milliseconds and 10
+	// seconds.
+	MinBackoff, MaxBackoff time.Duration
+
+	// Window is the maximum number of values that a net-chan opened for sending keeps
+	// for retransmission, waiting for the peer to acknowledge their delivery. When the
+	// window is full, no more values are taken from the channel. The default is 1024.
+	Window int
+
+	// AckInterval is how often the receiver of a net-chan acknowledges the values it
+	// delivered, if it did not do it already because a quarter of the window has been
+	// delivered. The default is 20 milliseconds.
+	AckInterval time.Duration
+}
+
+const (
+	defMinBackoff  = 100 * time.Millisecond
+	defMaxBackoff  = 10 * time.Second
+	defWindow      = 1024
+	defAckInterval = 20 * time.Millisecond
+)
+
+func (o *ResumeOptions) setDefaults() error {
+	if o.MinBackoff < 0 || o.MaxBackoff < 0 || o.Window < 0 || o.AckInterval < 0 {
+		return fmtErr("negative ResumeOptions field")
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = defMinBackoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = defMaxBackoff
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+	if o.Window == 0 {
+		o.Window = defWindow
+	}
+	if o.AckInterval == 0 {
+		o.AckInterval = defAckInterval
+	}
+	return nil
+}
+
+// ResumeChanName is the name of the net-chan that resumable sessions use to exchange
+// acknowledgments; it can't be used by the application.
+const ResumeChanName = "netchan.resume"
+
+/*
+A ResumableSession runs a Session on each connection returned by its dial function, one
+at a time. The channels of the user are not given to the sessions: for each net-chan, a
+pump goroutine moves the values between the channel of the user and a channel opened on
+the current session, and it survives the sessions.
+
+Delivery is tracked by counting: the values of a net-chan are numbered in order, from 0,
+by both peers. The receiver periodically acknowledges how many values it has delivered
+to the user, on the net-chan ResumeChanName; the sender keeps the values that have not
+been acknowledged yet. When a new session starts, the receiver opens the net-chan again
+and immediately sends an acknowledgment, which tells the sender where to resume: the
+sender opens the net-chan only after receiving it, then retransmits the values it kept
+from that point on. As values are never delivered twice or skipped, the receiver just
+keeps counting.
+
+The acknowledgments of the reliable mode (see reliable.go) can not replace these: they
+cover whole batches and are numbered per session, so the sender would know which values
+may have been lost, but not which of them the receiver delivered before the connection
+broke. Resending them would deliver some values twice.
+
+A name can be reused, so each net-chan opened for receiving has an id, unique in the
+ResumableSession, which the receiver puts in its acknowledgments. The sender pairs with
+the first receiver that acknowledges the name while open and, from then on, considers
+only the acknowledgments with its id. When the net-chan is closed by the sender, the
+receiver remembers its final count, so that it can tell the sender, even on a later
+session, that everything has been delivered: then the sender forgets the net-chan and
+tells the receiver to forget it too (Forget). If that message is lost, the receiver will
+send the final count again on the next session and the sender, which does not know the
+id anymore, will answer again.
+*/
+
+// ErrResumableClosed is the error of a ResumableSession closed with Quit.
+var ErrResumableClosed = errors.New("netchan: resumable session closed")
+
+// A ResumableSession is a netchan session that survives the failures of its connection.
+// When the connection breaks, a new one is obtained with the dial function and the
+// net-chans are opened again on it; the values that were lost in flight are sent again,
+// so the application goroutines see just a pause. Both peers must use a
+// ResumableSession.
+//
+// Net-chans are opened with OpenSend and OpenRecv, with the same rules of Session;
+// however, the net-chans can't be closed by the receiver. A name can be opened again for
+// sending when the peer has delivered all the values of the previous net-chan, and for
+// receiving when the previous channel has been closed.
+type ResumableSession struct {
+	dial func() (io.ReadWriteCloser, error)
+	opts ResumeOptions
+
+	mu        sync.Mutex
+	conn      *resumeConn   // nil while connecting
+	changed   chan struct{} // closed and replaced when conn changes or the end comes
+	ended     bool
+	err       error
+	done      chan struct{}
+	senders   map[string]*resumeSender
+	receivers map[string]bool
+	lastId    uint64                  // of the net-chans opened for receiving
+	acks      map[resumeKey]resumeMsg // received on conn
+	completed map[resumeKey]uint64    // closed by the peer, with their count
+}
+
+// resumeKey identifies a net-chan opened for receiving, see resumeMsg.
+type resumeKey struct {
+	name string
+	id   uint64
+}
+
+// A session created by a ResumableSession.
+type resumeConn struct {
+	ssn  *Session
+	gen  int            // generation, 1 for the first session
+	ctrl chan resumeMsg // to the peer, on ResumeChanName
+}
+
+// A message on ResumeChanName: an acknowledgment, sent by the receiver of a net-chan to
+// the sender, the notice that the sender has seen the final acknowledgment, or the
+// notice that the peer is quitting.
+type resumeMsg struct {
+	Name      string
+	Id        uint64 // chosen by the receiver when the net-chan is opened
+	Delivered uint64 // number of values delivered to the user
+	Closed    bool   // the net-chan has been closed and all the values delivered
+	Forget    bool   // sent by the sender, after it received the ack with Closed set
+	Quit      bool   // the peer called Quit; the other fields are empty
+}
+
+// NewResumableSession returns a ResumableSession that obtains its connections by calling
+// dial, with the options opts, which can be nil. dial is called again, with exponential
+// backoff, when it fails or when the connection breaks; it can also wait for a
+// connection on a listener, on the passive side of the session. The session ends when
+// Quit is called, when the peer quits or if the options are invalid.
+func NewResumableSession(dial func() (io.ReadWriteCloser, error),
+	opts *ResumeOptions) *ResumableSession {
+	var o ResumeOptions
+	if opts != nil {
+		o = *opts
+	}
+	r := &ResumableSession{dial: dial, changed: make(chan struct{}),
+		done: make(chan struct{}), senders: make(map[string]*resumeSender),
+		receivers: make(map[string]bool), acks: make(map[resumeKey]resumeMsg),
+		completed: make(map[resumeKey]uint64)}
+	if err := o.setDefaults(); err != nil {
+		r.end(err)
+		return r
+	}
+	r.opts = o
+	go r.run()
+	return r
+}
+
+// run connects, again and again.
+func (r *ResumableSession) run() {
+	backoff := r.opts.MinBackoff
+	var sOpts SessionOptions
+	if r.opts.Session != nil {
+		sOpts = *r.opts.Session
+	}
+	for gen := 1; ; {
+		conn, err := r.dial()
+		if err == nil {
+			var ssn *Session
+			ssn, err = NewSessionWithOptions(conn, &sOpts)
+			if err != nil {
+				conn.Close()
+				r.end(err)
+				return
+			}
+			if !r.connected(ssn, gen) {
+				ssn.Quit()
+				return
+			}
+			gen++
+			backoff = r.opts.MinBackoff
+			<-ssn.Done()
+			err = ssn.Err()
+			if err == EndOfSession {
+				r.end(err) // the peer quit
+			}
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			ssn.logSession(slog.LevelWarn, "resumable session disconnected",
+				slog.Any("error", err))
+		}
+		select {
+		case <-time.After(backoff):
+		case <-r.done:
+			return
+		}
+		if backoff *= 2; backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+}
+
+// connected installs a new session and opens the acknowledgment channels on it. It
+// returns false if the ResumableSession has ended.
+func (r *ResumableSession) connected(ssn *Session, gen int) bool {
+	conn := &resumeConn{ssn: ssn, gen: gen, ctrl: make(chan resumeMsg)}
+	ctrlIn := make(chan resumeMsg, 64)
+	if err := ssn.OpenSend(ResumeChanName, conn.ctrl); err != nil {
+		ssn.QuitWith(err)
+		return true
+	}
+	if err := ssn.OpenRecv(ResumeChanName, ctrlIn, cap(ctrlIn)); err != nil {
+		ssn.QuitWith(err)
+		return true
+	}
+	r.mu.Lock()
+	if r.ended {
+		r.mu.Unlock()
+		return false
+	}
+	r.conn = conn
+	r.acks = make(map[resumeKey]resumeMsg)
+	var completed []resumeMsg
+	for key, n := range r.completed {
+		completed = append(completed, resumeMsg{Name: key.name, Id: key.id, Delivered: n,
+			Closed: true})
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+
+	go r.dispatchAcks(conn, ctrlIn)
+	go func() {
+		for _, ack := range completed {
+			conn.sendAck(ack)
+		}
+	}()
+	return true
+}
+
+// dispatchAcks receives the acknowledgments of the peer and wakes up the senders. It
+// also handles the Forget messages, for the receivers.
+func (r *ResumableSession) dispatchAcks(conn *resumeConn, ctrlIn <-chan resumeMsg) {
+	for {
+		var ack resumeMsg
+		select {
+		case ack = <-ctrlIn:
+		case <-conn.ssn.Done():
+			return
+		}
+		if ack.Quit {
+			r.end(EndOfSession)
+			conn.ssn.Quit()
+			return
+		}
+		key := resumeKey{ack.Name, ack.Id}
+		r.mu.Lock()
+		if r.conn != conn {
+			r.mu.Unlock()
+			return
+		}
+		if ack.Forget {
+			delete(r.completed, key)
+			r.mu.Unlock()
+			continue
+		}
+		last := r.acks[key]
+		if ack.Delivered < last.Delivered {
+			ack.Delivered = last.Delivered
+		}
+		ack.Closed = ack.Closed || last.Closed
+		r.acks[key] = ack
+		sender := r.senders[ack.Name]
+		forget := ack.Closed && (sender == nil || sender.id != ack.Id)
+		r.mu.Unlock()
+		if forget {
+			// the sender of this net-chan is gone, but the peer did not get the Forget
+			go conn.sendAck(resumeMsg{Name: ack.Name, Id: ack.Id, Forget: true})
+		}
+		if sender != nil {
+			select {
+			case sender.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// ack returns the last acknowledgment received on conn for the net-chan. If the sender
+// is not paired with a receiver yet, it pairs it with the receiver that acknowledged the
+// name while open, if any.
+func (s *resumeSender) ack(conn *resumeConn) (resumeMsg, bool) {
+	r := s.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != conn {
+		return resumeMsg{}, false
+	}
+	if s.id != 0 {
+		ack, ok := r.acks[resumeKey{s.name, s.id}]
+		return ack, ok
+	}
+	for key, ack := range r.acks {
+		if key.name == s.name && !ack.Closed {
+			s.id = key.id
+			return ack, true
+		}
+	}
+	return resumeMsg{}, false
+}
+
+// nextConn waits for a session newer than prev, which can be nil. It returns nil if
+// the ResumableSession has ended.
+func (r *ResumableSession) nextConn(prev *resumeConn) *resumeConn {
+	for {
+		r.mu.Lock()
+		conn, changed, ended := r.conn, r.changed, r.ended
+		r.mu.Unlock()
+		if ended {
+			return nil
+		}
+		if conn != nil && (prev == nil || conn.gen > prev.gen) {
+			return conn
+		}
+		<-changed
+	}
+}
+
+func (r *ResumableSession) end(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ended {
+		return
+	}
+	r.ended = true
+	r.err = err
+	close(r.changed)
+	close(r.done)
+}
+
+func (c *resumeConn) sendAck(ack resumeMsg) {
+	select {
+	case c.ctrl <- ack:
+	case <-c.ssn.Done():
+	}
+}
+
+// Quit ends the session and no new connection is attempted; Err will return
+// ErrResumableClosed. The peer is notified on the current connection, if any, and given
+// SessionOptions.QuitTimeout to close it, so that it won't try to reconnect; then the
+// connection is closed like with Session.Quit.
+func (r *ResumableSession) Quit() error {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+	r.end(ErrResumableClosed)
+	if conn == nil {
+		return nil
+	}
+	timer := time.NewTimer(conn.ssn.opts.QuitTimeout)
+	defer timer.Stop()
+	select {
+	case conn.ctrl <- resumeMsg{Quit: true}:
+		select {
+		case <-conn.ssn.Done():
+		case <-timer.C:
+		}
+	case <-conn.ssn.Done():
+	case <-timer.C:
+	}
+	return conn.ssn.Quit()
+}
+
+// Done returns a channel that is closed when the session ends. Errors of single
+// connections do not end the session.
+func (r *ResumableSession) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error that ended the session, nil if it is still running. When the
+// peer quits, it returns EndOfSession.
+func (r *ResumableSession) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// OpenSend opens a net-chan for sending, like Session.OpenSend. The values taken from
+// channel are kept until the peer acknowledges their delivery (see ResumeOptions.Window).
+func (r *ResumableSession) OpenSend(name string, channel interface{}) error {
+	ch := reflect.ValueOf(channel)
+	if ch.Kind() != reflect.Chan || ch.Type().ChanDir()&reflect.RecvDir == 0 {
+		return fmtErr("OpenSend requires a <-chan")
+	}
+	if name == ResumeChanName {
+		return fmtErr("OpenSend: name %s is reserved", name)
+	}
+	s := &resumeSender{r: r, name: name, userCh: ch, notify: make(chan struct{}, 1),
+		chanType: reflect.ChanOf(reflect.BothDir, ch.Type().Elem())}
+	r.mu.Lock()
+	if _, present := r.senders[name]; present {
+		r.mu.Unlock()
+		return fmtErr("channel %s is already open for sending", name)
+	}
+	r.senders[name] = s
+	r.mu.Unlock()
+	go s.run()
+	return nil
+}
+
+// OpenRecv opens a net-chan for receiving, like Session.OpenRecv.
+func (r *ResumableSession) OpenRecv(name string, channel interface{}, bufferCap int) error {
+	ch := reflect.ValueOf(channel)
+	if ch.Kind() != reflect.Chan || ch.Type().ChanDir()&reflect.SendDir == 0 {
+		return fmtErr("OpenRecv requires a chan<-")
+	}
+	if bufferCap <= 0 {
+		return fmtErr("OpenRecv bufferCap must be at least 1")
+	}
+	if name == ResumeChanName {
+		return fmtErr("OpenRecv: name %s is reserved", name)
+	}
+	r.mu.Lock()
+	if r.receivers[name] {
+		r.mu.Unlock()
+		return fmtErr("channel %s is already open for receiving", name)
+	}
+	r.receivers[name] = true
+	r.lastId++
+	rc := &resumeReceiver{r: r, name: name, id: r.lastId, userCh: ch, bufCap: bufferCap,
+		chanType: reflect.ChanOf(reflect.BothDir, ch.Type().Elem())}
+	r.mu.Unlock()
+	go rc.run()
+	return nil
+}
+
+// The pump of a net-chan opened for sending.
+type resumeSender struct {
+	r        *ResumableSession
+	name     string
+	id       uint64        // of the receiver, 0 until paired; guarded by r.mu
+	userCh   reflect.Value // <-chan T
+	chanType reflect.Type  // chan T
+	notify   chan struct{} // an acknowledgment arrived
+
+	retained   []reflect.Value // values not acknowledged yet
+	base       uint64          // number of the first retained value
+	userClosed bool
+}
+
+func (s *resumeSender) run() {
+	for conn := s.r.nextConn(nil); conn != nil; conn = s.r.nextConn(conn) {
+		if s.runConn(conn) {
+			s.r.mu.Lock()
+			delete(s.r.senders, s.name)
+			s.r.mu.Unlock()
+			conn.sendAck(resumeMsg{Name: s.name, Id: s.id, Forget: true})
+			return
+		}
+	}
+}
+
+// trim forgets the values that the peer has delivered.
+func (s *resumeSender) trim(delivered uint64) {
+	if delivered <= s.base {
+		return
+	}
+	n := int(delivered - s.base)
+	if n > len(s.retained) {
+		n = len(s.retained)
+	}
+	for i := 0; i < n; i++ {
+		s.retained[i] = reflect.Value{}
+	}
+	s.retained = s.retained[n:]
+	s.base += uint64(n)
+}
+
+// finished returns true if all the values have been delivered and the net-chan closed.
+func (s *resumeSender) finished(ack resumeMsg) bool {
+	return s.userClosed && ack.Closed && ack.Delivered == s.base+uint64(len(s.retained))
+}
+
+// runConn runs the net-chan on a session. It returns true when the net-chan is
+// finished, false if the session ends first.
+func (s *resumeSender) runConn(conn *resumeConn) bool {
+	done := conn.ssn.Done()
+	// wait for the receiver to tell where to resume from
+	var ack resumeMsg
+	for {
+		var ok bool
+		if ack, ok = s.ack(conn); ok {
+			break
+		}
+		select {
+		case <-s.notify:
+		case <-done:
+			return false
+		}
+	}
+	s.trim(ack.Delivered)
+	if s.finished(ack) {
+		return true
+	}
+	innerCh := reflect.MakeChan(s.chanType, 16)
+	if err := conn.ssn.OpenSend(s.name, innerCh.Interface()); err != nil {
+		conn.ssn.QuitWith(err)
+		return false
+	}
+	sendCases := [...]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: innerCh},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	}
+	send := func(val reflect.Value) bool {
+		sendCases[0].Send = val
+		i, _, _ := reflect.Select(sendCases[:])
+		return i == 0
+	}
+	for _, val := range s.retained {
+		if !send(val) {
+			return false
+		}
+	}
+	if s.userClosed {
+		innerCh.Close()
+	}
+
+	cases := [...]reflect.SelectCase{
+		{Dir: reflect.SelectRecv},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.notify)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	}
+	for {
+		cases[0].Chan = reflect.Value{}
+		if !s.userClosed && len(s.retained) < s.r.opts.Window {
+			cases[0].Chan = s.userCh
+		}
+		i, val, ok := reflect.Select(cases[:])
+		switch i {
+		case 0:
+			if !ok {
+				s.userClosed = true
+				innerCh.Close()
+				continue
+			}
+			s.retained = append(s.retained, val)
+			if !send(val) {
+				return false
+			}
+		case 1:
+			ack, _ = s.ack(conn)
+			s.trim(ack.Delivered)
+			if s.finished(ack) {
+				return true
+			}
+		case 2:
+			return false
+		}
+	}
+}
+
+// The pump of a net-chan opened for receiving.
+type resumeReceiver struct {
+	r        *ResumableSession
+	name     string
+	id       uint64
+	userCh   reflect.Value // chan<- T
+	chanType reflect.Type  // chan T
+	bufCap   int
+
+	delivered, acked uint64
+}
+
+func (rc *resumeReceiver) run() {
+	for conn := rc.r.nextConn(nil); conn != nil; conn = rc.r.nextConn(conn) {
+		if rc.runConn(conn) {
+			return
+		}
+	}
+}
+
+func (rc *resumeReceiver) sendAck(conn *resumeConn, closed bool) {
+	rc.acked = rc.delivered
+	conn.sendAck(resumeMsg{Name: rc.name, Id: rc.id, Delivered: rc.delivered,
+		Closed: closed})
+}
+
+// complete is called when the sender has closed the net-chan and all the values have
+// been delivered.
+func (rc *resumeReceiver) complete(conn *resumeConn) {
+	rc.r.mu.Lock()
+	rc.r.completed[resumeKey{rc.name, rc.id}] = rc.delivered
+	delete(rc.r.receivers, rc.name)
+	rc.r.mu.Unlock()
+	rc.userCh.Close()
+	rc.sendAck(conn, true)
+}
+
+// runConn runs the net-chan on a session. It returns true when the net-chan is
+// finished, false if the session ends first.
+func (rc *resumeReceiver) runConn(conn *resumeConn) bool {
+	innerCh := reflect.MakeChan(rc.chanType, 1)
+	if err := conn.ssn.OpenRecv(rc.name, innerCh.Interface(), rc.bufCap); err != nil {
+		conn.ssn.QuitWith(err)
+		return false
+	}
+	rc.sendAck(conn, false) // where to resume from
+	ticker := time.NewTicker(rc.r.opts.AckInterval)
+	defer ticker.Stop()
+	cases := [...]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: innerCh},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ticker.C)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(conn.ssn.Done())},
+	}
+	ackEvery := uint64(rc.r.opts.Window/4) + 1
+	for {
+		i, val, ok := reflect.Select(cases[:])
+		switch i {
+		case 0:
+			if !ok {
+				rc.complete(conn)
+				return true
+			}
+			rc.userCh.Send(val)
+			rc.delivered++
+			if rc.delivered-rc.acked >= ackEvery {
+				rc.sendAck(conn, false)
+			}
+		case 1:
+			if rc.delivered != rc.acked {
+				rc.sendAck(conn, false)
+			}
+		case 2:
+			// Deliver the values that arrived before the end of the session; the
+			// sender will retransmit the others.
+			drain := [...]reflect.SelectCase{
+				{Dir: reflect.SelectRecv, Chan: innerCh},
+				{Dir: reflect.SelectDefault},
+			}
+			for {
+				i, val, ok := reflect.Select(drain[:])
+				if i == 1 {
+					return false
+				}
+				if !ok {
+					rc.complete(conn)
+					return true
+				}
+				rc.userCh.Send(val)
+				rc.delivered++
+			}
+		}
+	}
+}
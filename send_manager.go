@@ -1,6 +1,8 @@
 package netchan
 
 import (
+	"context"
+	"log/slog"
 	"reflect"
 	"runtime"
 	"sync"
@@ -17,7 +19,14 @@ type sChans struct {
 type sChanInfo struct {
 	isOpenLocal    bool
 	isOpenRemote   bool
+	isClosing      bool // close message sent, waiting for the peer to acknowledge it
 	id, initCredit int
+	byteCredit     bool     // the credits are in bytes, see bytecredit.go
+	peerType       typeInfo // announced with the initial credit
+	peerDirs       uint8    // announced with the initial credit, see mismatch.go
+	wait           *openWait
+	stats          *chanStats
+	freed          chan struct{} // closed when the close has been acknowledged
 	sChans
 }
 
@@ -26,6 +35,7 @@ type sendTable struct {
 	sync.Mutex
 	chans  map[int]sChans
 	chInfo map[string]sChanInfo
+	acks   map[int]*ackTracker // of the net-chans in reliable mode, by id
 }
 
 // A sendProxy takes data from a channel and forwards it to the encoder.
@@ -35,13 +45,49 @@ type sendProxy struct {
 	chId      int
 	chName    string
 	dataCh    reflect.Value // <-chan T
+	batchType reflect.Type  // []T
 	creditCh  <-chan credit
 	toEncoder chan<- data
 	done      chan<- struct{}
 	table     *sendTable // table of the sendManager
+	waits     *waitTable // of the sendManager
+	wait      *openWait
+	stats     *chanStats
+	acks      *ackTracker // nil if the session is not reliable
 
-	credit        int
-	batchLenStats stats
+	credit     int
+	canceled   bool // the peer is not interested in our data anymore
+	byteCredit bool // the credits are in bytes, see bytecredit.go
+	sizeCh     chan int
+	measuring  bool // waiting for the encoder to report the size of the last batch
+
+	// values of the connection window held by the batches sent, see window.go
+	windowHeld    int
+	windowBatches []int // with byte credits, the length of each batch held
+}
+
+func (s *sendProxy) recvCredit(c credit) {
+	switch c.Type {
+	case cancelMsg:
+		s.canceled = true
+		s.wait.fail(ErrClosedByPeer)
+		s.ssn.logChan(slog.LevelDebug, "channel canceled by peer", dirSend, s.chName,
+			s.chId, slog.String("error", c.Err))
+	case resetMsg:
+		s.canceled = true
+		s.wait.fail(fmtErr("net-chan %s reset by peer: %s", s.chName, c.Err))
+		s.ssn.logChan(slog.LevelWarn, "channel reset by peer", dirSend, s.chName,
+			s.chId, slog.String("error", c.Err))
+	case rejectMsg:
+		s.canceled = true
+		s.wait.fail(&rejection{chName: s.chName, reason: c.Err})
+		s.ssn.logChan(slog.LevelWarn, "channel rejected by peer", dirSend, s.chName,
+			s.chId, slog.String("error", c.Err))
+	default:
+		s.credit += c.amount
+		atomic.AddInt64(&s.stats.pending, -int64(c.amount))
+		s.releaseWindow(c.amount)
+	}
 }
 
 func (s *sendProxy) sendToEncoder(dat data) {
@@ -53,72 +99,184 @@ func (s *sendProxy) sendToEncoder(dat data) {
 		case s.toEncoder <- dat:
 			return
 		case c := <-s.creditCh:
-			s.credit += c.amount
+			s.recvCredit(c)
 		case <-s.ssn.Done():
 			return
 		}
 	}
 }
 
+// useCredit takes the credit for a value. With byte credits, the credit is taken when
+// the encoder reports the size of the batch.
+func (s *sendProxy) useCredit() {
+	if !s.byteCredit {
+		s.credit--
+	}
+}
+
 func (s *sendProxy) tryRecvCredit() {
 	select {
 	case c := <-s.creditCh:
-		s.credit += c.amount
+		s.recvCredit(c)
 		return
 	default:
 	}
 	runtime.Gosched()
 	select {
 	case c := <-s.creditCh:
-		s.credit += c.amount
+		s.recvCredit(c)
 	default:
 	}
 }
 
-func (s *sendProxy) run() {
-	defer close(s.done)
+// close sends the close message to the peer. The net-chan is removed from the table
+// by the sendManager, when the peer acknowledges the close.
+func (s *sendProxy) close() {
+	s.table.Lock()
+	ci := s.table.chInfo[s.chName]
+	ci.isOpenLocal = false
+	ci.isClosing = true
+	s.table.chInfo[s.chName] = ci
+	delete(s.table.chans, s.chId)
+	s.table.Unlock()
+	// If the initial credit has not arrived yet, s.chId is 0 and the peer will
+	// identify the net-chan by name.
+	closeH := header{Type: closeMsg, ChId: s.chId, ChName: s.chName}
+	closeH.Err, _ = localRejection(s.wait.error())
+	s.sendToEncoder(data{header: closeH})
+	s.wait.close()
+	s.waits.closed(s.chName, s.wait)
+	s.ssn.logChan(slog.LevelDebug, "channel closed", dirSend, s.chName, s.chId)
+}
 
-	// send the wantToSend message and receive the initial credit
-	wantToSend := data{header: header{initDataMsg, 0, s.chName}}
-	select {
-	case s.toEncoder <- wantToSend:
+// discard drains dataCh after the net-chan failed, so that the user does not block,
+// until the user closes it or the session is done.
+func (s *sendProxy) discard() {
+	recvCases := [...]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: s.dataCh},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.ssn.Done())},
+	}
+	for {
+		i, _, ok := reflect.Select(recvCases[:])
+		if i == 1 || !ok {
+			return
+		}
+	}
+}
+
+// checkSendType checks that values of type batchType can be received by the peer,
+// whose type is described by peerType.
+func checkSendType(chName string, batchType reflect.Type, peerType typeInfo) error {
+	// gob's compatibility rules are symmetric, so we can check the opposite direction.
+	if peerType.check(batchType) != nil {
+		return typeMismatch(chName, batchType.Elem().String(), peerType.name, nil)
+	}
+	return nil
+}
+
+// init sends the wantToSend message and receives the initial credit. It returns false
+// if the net-chan can not be used.
+func (s *sendProxy) init() bool {
+	wantToSend := data{header: header{Type: initDataMsg, ChName: s.chName,
+		Dirs: s.ssn.openDirs(s.chName)}}
+	wantToSend.setTypeInfo(newTypeInfo(s.batchType, s.ssn.opts.Codec))
+	toEncoder := s.toEncoder
+Loop:
+	for {
 		select {
+		case toEncoder <- wantToSend:
+			toEncoder = nil
 		case c := <-s.creditCh:
 			s.chId = c.ChId
 			s.credit = c.amount
+			s.byteCredit = c.ByteCredit
+			// The peer checks the types too, but the open must fail on this side
+			// before the user sees it succeed.
+			if err := checkSendType(s.chName, s.batchType, c.typeInfo()); err != nil {
+				s.wait.cancel(err)
+			}
+			break Loop
+		case <-s.wait.canceled:
+			break Loop
 		case <-s.ssn.Done():
-			return
+			return false
 		}
-	case c := <-s.creditCh:
-		s.chId = c.ChId
-		s.credit = c.amount
+	}
+	if toEncoder != nil {
 		s.sendToEncoder(wantToSend)
-	case <-s.ssn.Done():
-		return
 	}
-	defer logDebug("netchan session %d: batchLen stats for channel send%d (%s):\n\t%s",
-		s.ssn.id, s.chId, s.chName, &s.batchLenStats)
+	if !s.wait.setReady() {
+		// the open was canceled while waiting for the peer
+		s.close()
+		return false
+	}
+	return true
+}
 
-	batchType := reflect.SliceOf(s.dataCh.Type().Elem())
+func (s *sendProxy) run() {
+	defer close(s.done)
+	defer s.wait.finish()
+	s.ssn.window.join()
+	defer s.ssn.window.leave()
+	if !s.init() {
+		return
+	}
+	if s.acks != nil {
+		s.table.Lock()
+		s.table.acks[s.chId] = s.acks
+		s.table.Unlock()
+	}
+	if s.byteCredit {
+		s.sizeCh = make(chan int, 1)
+	}
 	// The encoder will calculate the desired batch length for this channel,
 	// based on the size of the encoded items, and update *batchLenPt for us.
 	batchLenPt := new(int32)
-	*batchLenPt = 10 // initial guess
+	*batchLenPt = int32(s.ssn.opts.InitialBatchLen) // initial guess
 	recvDataCases := [...]reflect.SelectCase{
 		{Dir: reflect.SelectRecv, Chan: s.dataCh},
 		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.creditCh)},
 		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.ssn.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.wait.canceled)},
 	}
 	const (
 		recvData int = iota
 		recvCredit
 		recvDone
+		recvStop
 	)
 	for {
+		if s.wait.isFailed() {
+			s.close()
+			s.wait.finish()
+			s.discard()
+			return
+		}
+		if s.canceled || s.wait.isClosed() {
+			s.close()
+			return
+		}
+		if s.measuring {
+			select {
+			case size := <-s.sizeCh:
+				s.measuring = false
+				s.credit -= batchCost(size)
+				atomic.AddInt64(&s.stats.pending, int64(batchCost(size)))
+			case c := <-s.creditCh:
+				s.recvCredit(c)
+			case <-s.wait.canceled:
+			case <-s.ssn.Done():
+				return
+			}
+			continue
+		}
 		if s.credit <= 0 {
+			atomic.AddInt64(&s.ssn.stats.creditStalls, 1)
 			select {
 			case c := <-s.creditCh:
-				s.credit += c.amount
+				s.recvCredit(c)
+				continue
+			case <-s.wait.canceled:
 				continue
 			case <-s.ssn.Done():
 				return
@@ -128,21 +286,26 @@ func (s *sendProxy) run() {
 		switch i {
 		case recvData:
 			if !ok {
-				s.sendToEncoder(data{header: header{closeMsg, s.chId, ""}})
-				s.table.Lock()
-				delete(s.table.chans, s.chId)
-				delete(s.table.chInfo, s.chName)
-				s.table.Unlock()
-				logDebug("netchan session %d: channel send%d (%s) closed",
-					s.ssn.id, s.chId, s.chName)
+				s.close()
 				return
 			}
-			s.credit--
-			batch := reflect.MakeSlice(batchType, 1, 8)
-			batch.Index(0).Set(val)
+			s.useCredit()
 			batchLen := int(atomic.LoadInt32(batchLenPt))
+			if !s.byteCredit && batchLen > s.credit+1 {
+				batchLen = s.credit + 1
+			}
+			batch := reflect.MakeSlice(s.batchType, 1, 8)
+			batch.Index(0).Set(val)
+			if batchLen = s.acquireWindow(batchLen); batchLen == 0 {
+				// The net-chan stopped, so the value will not be sent; in reliable
+				// mode, Unacked reports it with the values not acknowledged.
+				if s.acks != nil {
+					s.acks.add(batch)
+				}
+				continue
+			}
 			for i := 1; i < batchLen; i++ {
-				if s.credit <= 0 {
+				if !s.byteCredit && s.credit <= 0 {
 					s.tryRecvCredit()
 					if s.credit <= 0 {
 						break
@@ -156,15 +319,35 @@ func (s *sendProxy) run() {
 				if !ok {
 					break
 				}
-				s.credit--
+				s.useCredit()
 				batch = reflect.Append(batch, val)
 			}
-			s.batchLenStats.update(float64(batch.Len()))
-			s.sendToEncoder(data{header{dataMsg, s.chId, ""}, batch, batchLenPt})
+			s.ssn.window.release(batchLen - batch.Len())
+			s.ssn.stats.addBatch(batch.Len())
+			s.stats.addBatch(batch.Len())
+			if !s.byteCredit {
+				atomic.AddInt64(&s.stats.pending, int64(batch.Len()))
+			}
+			if s.ssn.opts.Metrics != nil {
+				s.ssn.opts.Metrics.BatchSent(s.chName, batch.Len())
+			}
+			dataH := header{Type: dataMsg, ChId: s.chId}
+			if s.ssn.window.limited() {
+				dataH.BatchLen = batch.Len()
+				s.holdWindow(batch.Len())
+			}
+			if s.acks != nil {
+				dataH.Seq = s.acks.add(batch)
+			}
+			s.sendToEncoder(data{header: dataH, batch: batch, batchLenPt: batchLenPt,
+				sizeCh: s.sizeCh})
+			s.measuring = s.byteCredit
 		case recvCredit:
-			s.credit += val.Interface().(credit).amount
+			s.recvCredit(val.Interface().(credit))
 		case recvDone:
 			return
+		case recvStop:
+			// checked at the beginning of the loop
 		}
 	}
 }
@@ -174,6 +357,7 @@ type sendManager struct {
 	creditCh  <-chan credit
 	toEncoder chan<- data
 	table     sendTable
+	waits     waitTable
 }
 
 // Open a net-chan for sending.
@@ -188,34 +372,84 @@ type sendManager struct {
 //     In this case, open adds the entry to the pending table (we don't know the channel
 //     id yet), with 0 credit. When the message arrives, we patch the entry with the
 //     credit and move it from the pending table to the final table.
-func (s *sendManager) open(chName string, ch reflect.Value) error {
+//
+// If the last net-chan with the same name is being closed, open waits until the peer
+// acknowledges the close. Then the peer knows that the messages with that name refer
+// to a new net-chan, which will be paired with the next one opened by the peer.
+func (s *sendManager) open(ctx context.Context, chName string, ch reflect.Value) (*NetChan,
+	error) {
 	s.table.Lock()
-	ci := s.table.chInfo[chName]
-	if ci.isOpenLocal {
+	var ci sChanInfo
+	for {
+		ci = s.table.chInfo[chName]
+		if ci.isOpenLocal && !ci.wait.isStopped() {
+			s.table.Unlock()
+			return nil, fmtErr("channel %s is already open for sending", chName)
+		}
+		if !ci.isOpenLocal && !ci.isClosing {
+			break
+		}
+		s.table.Unlock()
+		select {
+		case <-ci.freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.ssn.Done():
+			return nil, s.ssn.Err()
+		}
+		s.table.Lock()
+	}
+	if err := s.ssn.reserveChan(chName, 0); err != nil {
 		s.table.Unlock()
-		return fmtErr("channel %s is already open for sending", chName)
+		return nil, err
+	}
+	if ci.freed == nil {
+		ci.freed = make(chan struct{})
 	}
 	ci.isOpenLocal = true
-	creditCh := make(chan credit, internalChCap)
-	done := make(chan struct{}, internalChCap)
+	creditCh := make(chan credit, s.ssn.opts.InternalChanCap)
+	done := make(chan struct{}, s.ssn.opts.InternalChanCap)
 	ci.creditCh = creditCh
 	ci.done = done
+	ci.wait = newOpenWait()
+	ci.stats = new(chanStats)
 	s.table.chInfo[chName] = ci
+	s.waits.put(chName, ci.wait)
+	batchType := reflect.SliceOf(ch.Type().Elem())
+	var typeErr error
 	if ci.isOpenRemote {
 		s.table.chans[ci.id] = sChans{creditCh, done}
-		creditCh <- credit{header{initCreditMsg, ci.id, chName}, ci.initCredit}
+		initCred := header{Type: initCreditMsg, ChId: ci.id, ChName: chName,
+			ByteCredit: ci.byteCredit}
+		initCred.setTypeInfo(ci.peerType)
+		creditCh <- credit{initCred, ci.initCredit}
+		// If the types do not match, the sendProxy closes the net-chan.
+		typeErr = checkSendType(chName, batchType, ci.peerType)
+		if typeErr != nil {
+			ci.wait.cancel(typeErr)
+		}
 	}
 	s.table.Unlock()
 
-	go (&sendProxy{s.ssn, 0, chName, ch, creditCh,
-		s.toEncoder, done, &s.table, 0, stats{}}).run()
+	nc := &NetChan{ssn: s.ssn, name: chName, wait: ci.wait, stats: ci.stats}
+	if s.ssn.opts.Reliable {
+		nc.acks = &ackTracker{batchType: batchType}
+	}
+	go (&sendProxy{ssn: s.ssn, chName: chName, dataCh: ch, batchType: batchType,
+		creditCh: creditCh, toEncoder: s.toEncoder, done: done, table: &s.table,
+		waits: &s.waits, wait: ci.wait, stats: nc.stats, acks: nc.acks}).run()
+	if typeErr != nil {
+		s.ssn.logChan(slog.LevelWarn, "open failed", dirSend, chName, ci.id,
+			slog.Any("error", typeErr))
+		return nil, typeErr
+	}
 	if ci.isOpenRemote {
-		logDebug("netchan session %d: channel %s opened as send%d",
-			s.ssn.id, chName, ci.id)
-		return nil
+		s.ssn.logChan(slog.LevelDebug, "channel opened", dirSend, chName, ci.id)
+		return nc, nil
 	}
-	logDebug("netchan session %d: opening channel %s for sending", s.ssn.id, chName)
-	return nil
+	s.ssn.logChan(slog.LevelDebug, "opening channel", dirSend, chName, 0)
+	s.ssn.checkDirections(chName)
+	return nc, nil
 }
 
 // Got a credit from the decoder.
@@ -240,20 +474,36 @@ func (s *sendManager) handleCredit(cred credit) {
 //     When we receive an initial credit message, we have to store an entry in the table
 //     and we say that the net-chan is half-open, until the user calls Open(Send)
 //     locally. When we see too many half-open net-chans, we assume it's a "syn-flood"
-//     attack and shut down with an error.
-const maxHalfOpen = 256
+//     attack and shut down with an error. The limit is SessionOptions.MaxHalfOpen.
 
 // An initial credit arrived.
 func (s *sendManager) handleInitCredit(cred credit) error {
 	s.table.Lock()
 	ci := s.table.chInfo[cred.ChName]
-	if ci.isOpenRemote {
+	s.table.Unlock()
+	if ignore, err := checkInitCredit(ci); ignore {
+		return err
+	}
+	rejErr := s.ssn.authorize(cred.ChName, false, cred.ElemType)
+	s.table.Lock()
+	// the sendProxy may have closed the net-chan meanwhile
+	ci = s.table.chInfo[cred.ChName]
+	if ignore, err := checkInitCredit(ci); ignore {
 		s.table.Unlock()
-		return fmtErr("received initial credit for already open channel")
+		return err
 	}
 	ci.isOpenRemote = true
+	if ci.freed == nil {
+		ci.freed = make(chan struct{})
+	}
 	ci.id = cred.ChId
 	ci.initCredit = cred.amount
+	ci.byteCredit = cred.ByteCredit
+	ci.peerType = cred.typeInfo()
+	ci.peerDirs = cred.Dirs
+	if rejErr != nil {
+		return s.reject(ci, cred, rejErr)
+	}
 	s.table.chInfo[cred.ChName] = ci
 	if ci.isOpenLocal {
 		s.table.chans[cred.ChId] = ci.sChans
@@ -263,18 +513,120 @@ func (s *sendManager) handleInitCredit(cred credit) error {
 	s.table.Unlock()
 
 	if ci.isOpenLocal {
-		logDebug("netchan session %d: channel %s opened as send%d",
-			s.ssn.id, cred.ChName, ci.id)
+		s.ssn.logChan(slog.LevelDebug, "channel opened", dirSend, cred.ChName, ci.id)
 		return nil
 	}
-	logDebug("netchan session %d: peer wants to receive on channel %s",
-		s.ssn.id, cred.ChName)
-	if halfOpen >= maxHalfOpen {
+	s.ssn.logChan(slog.LevelDebug, "peer wants to receive on channel", dirSend,
+		cred.ChName, ci.id)
+	if halfOpen >= s.ssn.opts.MaxHalfOpen {
 		return fmtErr("too many half open channels")
 	}
+	s.ssn.checkDirections(cred.ChName)
 	return nil
 }
 
+// checkInitCredit returns ignore true if an initial credit for the net-chan ci must not
+// be handled, with an error if it violates the protocol.
+func checkInitCredit(ci sChanInfo) (ignore bool, err error) {
+	if ci.isClosing {
+		// We sent the close message before the peer opened the net-chan; when the
+		// peer gets it, it will close the net-chan on its side too.
+		return true, nil
+	}
+	if ci.isOpenRemote {
+		return true, fmtErr("received initial credit for already open channel")
+	}
+	return false, nil
+}
+
+// reject closes a net-chan whose initial credit has been rejected by the Authorizer.
+// It is called with the table locked and unlocks it.
+func (s *sendManager) reject(ci sChanInfo, cred credit, rejErr error) error {
+	if ci.isOpenLocal {
+		// the sendProxy closes the net-chan, telling the peer why
+		ci.wait.cancel(rejErr)
+	} else {
+		ci.isClosing = true
+	}
+	s.table.chInfo[cred.ChName] = ci
+	halfOpen := len(s.table.chInfo) - len(s.table.chans)
+	s.table.Unlock()
+	if !ci.isOpenLocal {
+		reason, _ := localRejection(rejErr)
+		go func() {
+			select {
+			case s.toEncoder <- data{header: header{Type: closeMsg, ChId: cred.ChId,
+				ChName: cred.ChName, Err: reason}}:
+			case <-s.ssn.Done():
+			}
+		}()
+	}
+	s.ssn.logChan(slog.LevelWarn, "open rejected", dirSend, cred.ChName, cred.ChId,
+		slog.Any("error", rejErr))
+	if halfOpen >= s.ssn.opts.MaxHalfOpen {
+		return fmtErr("too many half open channels")
+	}
+	return nil
+}
+
+// The peer does not want to receive on a net-chan anymore, it reset the net-chan or it
+// rejected it.
+func (s *sendManager) handleCancel(cred credit) {
+	s.table.Lock()
+	ci, present := s.table.chInfo[cred.ChName]
+	if cred.Type == rejectMsg && present && ci.isOpenLocal && !ci.isOpenRemote &&
+		!ci.isClosing {
+		// Rejected before the initial credit: the sendProxy closes the net-chan.
+		s.table.Unlock()
+		ci.wait.cancel(&rejection{chName: cred.ChName, reason: cred.Err})
+		s.ssn.logChan(slog.LevelWarn, "channel rejected by peer", dirSend, cred.ChName,
+			0, slog.String("error", cred.Err))
+		return
+	}
+	if !present || !ci.isOpenRemote || ci.id != cred.ChId || ci.isClosing {
+		// already closed, the peer will get our close message
+		s.table.Unlock()
+		return
+	}
+	if ci.isOpenLocal {
+		// let the sendProxy close the net-chan
+		s.table.Unlock()
+		select {
+		case ci.creditCh <- cred:
+		case <-ci.done:
+		}
+		return
+	}
+	// The net-chan is half-open, close it on behalf of the user. As the sendManager
+	// must not send to the encoder, we use another goroutine; the entry will not be
+	// reused before the peer acknowledges the close, so ordering is not an issue.
+	ci.isClosing = true
+	s.table.chInfo[cred.ChName] = ci
+	s.table.Unlock()
+	go func() {
+		select {
+		case s.toEncoder <- data{header: header{Type: closeMsg, ChId: cred.ChId,
+			ChName: cred.ChName}}:
+		case <-s.ssn.Done():
+		}
+	}()
+}
+
+// The peer acknowledged the close of a net-chan, now we can forget about it.
+func (s *sendManager) handleCloseAck(cred credit) {
+	s.table.Lock()
+	ci := s.table.chInfo[cred.ChName]
+	if ci.isClosing {
+		if ci.wait != nil {
+			s.ssn.releaseChan(0) // it was opened locally
+		}
+		delete(s.table.chInfo, cred.ChName)
+		delete(s.table.acks, ci.id)
+		close(ci.freed)
+	}
+	s.table.Unlock()
+}
+
 func (s *sendManager) run() {
 	for c := range s.creditCh {
 		switch c.Type {
@@ -285,6 +637,54 @@ func (s *sendManager) run() {
 			if err != nil {
 				go s.ssn.QuitWith(err)
 			}
+		case cancelMsg, resetMsg, rejectMsg:
+			s.handleCancel(c)
+		case closeAckMsg:
+			s.handleCloseAck(c)
+		case ackMsg:
+			s.handleAck(c)
+		}
+	}
+}
+
+// busy returns the freed channel of a net-chan that is open locally for sending or
+// whose close has not been acknowledged yet. It returns nil if there is no such
+// net-chan.
+func (s *sendManager) busy() <-chan struct{} {
+	s.table.Lock()
+	defer s.table.Unlock()
+	for _, ci := range s.table.chInfo {
+		if ci.isOpenLocal || ci.isClosing {
+			return ci.freed
+		}
+	}
+	return nil
+}
+
+// stats returns the statistics of the net-chans open locally, and counts the open and
+// half-open net-chans.
+func (s *sendManager) stats() (chans map[string]ChanStats, open, halfOpen int) {
+	chans = make(map[string]ChanStats)
+	s.table.Lock()
+	defer s.table.Unlock()
+	for chName, ci := range s.table.chInfo {
+		if ci.isOpenLocal {
+			chans[chName] = ci.stats.snapshot()
+		}
+		switch {
+		case ci.isClosing:
+		case ci.isOpenLocal && ci.isOpenRemote:
+			open++
+		default:
+			halfOpen++
 		}
 	}
+	return
+}
+
+// info returns the table entry of a net-chan.
+func (s *sendManager) info(chName string) sChanInfo {
+	s.table.Lock()
+	defer s.table.Unlock()
+	return s.table.chInfo[chName]
 }
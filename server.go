@@ -0,0 +1,228 @@
+package netchan
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Server.Serve and ListenAndServe after Shutdown or
+// Close has been called.
+var ErrServerClosed = errors.New("netchan: server closed")
+
+// A Server accepts connections from listeners and starts a session on each of them. All
+// its methods can be called safely from multiple goroutines.
+type Server struct {
+	handler func(*Session)
+	opts    SessionOptions
+	optsErr error
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	sessions  map[*Session]struct{}
+}
+
+// NewServer returns a server that creates its sessions with the options opts, which can
+// be nil, and calls handler in a new goroutine for each session, when the handshake with
+// the peer is complete (sessions that fail before are not handled). If
+// opts.HandshakeTimeout is 0, the server uses 10 seconds, so that the clients that never
+// send the hello message do not hold a session forever. The session keeps
+// running after handler returns: handler can open the net-chans and leave them to other
+// goroutines, or terminate the session itself.
+func NewServer(handler func(*Session), opts *SessionOptions) *Server {
+	srv := &Server{handler: handler, listeners: make(map[net.Listener]struct{}),
+		sessions: make(map[*Session]struct{})}
+	if opts != nil {
+		srv.opts = *opts
+	}
+	if srv.opts.HandshakeTimeout == 0 {
+		srv.opts.HandshakeTimeout = defServerHandshakeTimeout
+	}
+	srv.optsErr = srv.opts.setDefaults()
+	return srv
+}
+
+// ListenAndServe listens on the network address addr and calls Serve.
+func (srv *Server) ListenAndServe(network, addr string) error {
+	if srv.isClosed() {
+		return ErrServerClosed
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections from l and starts a session on each of them. Serve always
+// returns an error and closes l: ErrServerClosed after Shutdown or Close, the error of
+// the listener otherwise, or the error of the options of the server. Temporary errors of
+// the listener (such as running out of file descriptors) are retried with backoff, as
+// net/http does. A server can serve multiple listeners at the same time.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if srv.optsErr != nil {
+		return srv.optsErr
+	}
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+	}()
+
+	var delay time.Duration // how long to sleep after a temporary error
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if !isTemporary(err) {
+				return err
+			}
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		ssn, _ := NewSessionWithOptions(conn, &srv.opts) // options already checked
+		if !srv.track(ssn) {
+			ssn.Quit()
+			return ErrServerClosed
+		}
+		go srv.handle(ssn)
+	}
+}
+
+// Bounds of the backoff of Serve after a temporary error of the listener.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
+// isTemporary reports whether err is a temporary error of a listener, which Serve
+// retries.
+func isTemporary(err error) bool {
+	var ne interface{ Temporary() bool }
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
+// handle calls the handler when the handshake is complete, see Session.Handshake.
+func (srv *Server) handle(ssn *Session) {
+	if ssn.Handshake(context.Background()) == nil {
+		srv.handler(ssn)
+	}
+}
+
+// track adds a session to the live ones, until it shuts down. It returns false if the
+// server has been closed.
+func (srv *Server) track(ssn *Session) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	srv.sessions[ssn] = struct{}{}
+	go func() {
+		<-ssn.Done()
+		srv.forget(ssn)
+	}()
+	return true
+}
+
+func (srv *Server) forget(ssn *Session) {
+	srv.mu.Lock()
+	delete(srv.sessions, ssn)
+	srv.mu.Unlock()
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// close stops the listeners and returns the live sessions.
+func (srv *Server) close() ([]*Session, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closed = true
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return srv.sessionList(), err
+}
+
+func (srv *Server) sessionList() []*Session {
+	list := make([]*Session, 0, len(srv.sessions))
+	for ssn := range srv.sessions {
+		list = append(list, ssn)
+	}
+	return list
+}
+
+// Sessions returns the sessions of the server that are still running.
+func (srv *Server) Sessions() []*Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.sessionList()
+}
+
+// Shutdown stops accepting connections and shuts down all the sessions gracefully, in
+// parallel, with Session.Shutdown. It returns when all the sessions have terminated, or
+// when ctx is done: in that case it returns ctx.Err() and the sessions that have not
+// terminated keep running, without accepting new net-chans; call Close to terminate
+// them. Otherwise, it returns the error of closing the listeners, if any.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	sessions, err := srv.close()
+	var wg sync.WaitGroup
+	for _, ssn := range sessions {
+		wg.Add(1)
+		go func(ssn *Session) {
+			defer wg.Done()
+			ssn.Shutdown(ctx)
+			if ssn.Err() != nil {
+				srv.forget(ssn) // terminated
+			}
+		}(ssn)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Close stops accepting connections and terminates all the sessions immediately, with
+// Session.Quit. It returns the error of closing the listeners, if any.
+func (srv *Server) Close() error {
+	sessions, err := srv.close()
+	var wg sync.WaitGroup
+	for _, ssn := range sessions {
+		wg.Add(1)
+		go func(ssn *Session) {
+			defer wg.Done()
+			ssn.Quit()
+			srv.forget(ssn)
+		}(ssn)
+	}
+	wg.Wait()
+	return err
+}
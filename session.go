@@ -10,27 +10,17 @@ package netchan
 */
 
 import (
+	"context"
+	"crypto/x509"
 	"io"
+	"log/slog"
 	"net"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// NewContext returns a Context that is canceled either when parent is canceled or when
-// ssn ends.
-/*func NewContext(parent context.Context, ssn *Session) context.Context {
-	ctx, cancel := context.WithCancel(parent)
-	go func() {
-		select {
-		case <-ssn.Done():
-			cancel()
-		case <-ctx.Done():
-		}
-	}()
-	return ctx
-}*/
-
 // once is an implementation of sync.Once that uses a channel.
 type once struct {
 	done  chan struct{}
@@ -59,6 +49,181 @@ func (o *once) Do(f func()) {
 	close(o.done)
 }
 
+// openWait is used to wait until the peer opens a net-chan that has been opened
+// locally. The open can be canceled, because of an error or because the user is not
+// willing to wait anymore, but only until the net-chan becomes ready. After that, the
+// net-chan can still fail because of an error, or be closed.
+type openWait struct {
+	ready    chan struct{}
+	canceled chan struct{} // closed when the net-chan is canceled, fails or is closed
+	done     chan struct{} // closed when the proxy of the net-chan stops working
+	mu       sync.Mutex    // serializes the state transitions
+	state    int32
+	isDone   int32
+	err      error // why the open was canceled or the net-chan failed
+}
+
+// openWait state
+const (
+	openPending int32 = iota
+	openReady
+	openCanceled
+	openFailed
+	openClosed
+)
+
+var errNetChanClosed = fmtErr("net-chan closed")
+
+func newOpenWait() *openWait {
+	return &openWait{ready: make(chan struct{}), canceled: make(chan struct{}),
+		done: make(chan struct{})}
+}
+
+// transition moves the openWait to state to, if it is in one of the states from, and
+// records err. It returns the state before the transition and whether it took place.
+func (w *openWait) transition(to int32, err error, from ...int32) (int32, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	state := w.state
+	for _, f := range from {
+		if state == f {
+			w.err = err
+			atomic.StoreInt32(&w.state, to)
+			return state, true
+		}
+	}
+	return state, false
+}
+
+// setReady is called when the peer opens the net-chan. It returns false if the open
+// has been canceled.
+func (w *openWait) setReady() bool {
+	state, ok := w.transition(openReady, nil, openPending)
+	if ok {
+		close(w.ready)
+	}
+	return ok || state == openReady
+}
+
+// cancel returns false if the net-chan is already ready.
+func (w *openWait) cancel(err error) bool {
+	state, ok := w.transition(openCanceled, err, openPending)
+	if ok {
+		close(w.canceled)
+	}
+	return ok || state == openCanceled
+}
+
+// fail is called when a ready net-chan fails. It returns false if the net-chan is not
+// ready or has already failed.
+func (w *openWait) fail(err error) bool {
+	_, ok := w.transition(openFailed, err, openReady)
+	if ok {
+		close(w.canceled)
+	}
+	return ok
+}
+
+// close is called when the net-chan is closed without errors, locally or by the peer.
+// It returns false if the net-chan has already been canceled, failed or closed.
+func (w *openWait) close() bool {
+	_, ok := w.transition(openClosed, nil, openReady, openPending)
+	if ok {
+		close(w.canceled)
+	}
+	return ok
+}
+
+// finish is called by the proxy of the net-chan when it stops working.
+func (w *openWait) finish() {
+	if atomic.CompareAndSwapInt32(&w.isDone, 0, 1) {
+		close(w.done)
+	}
+}
+
+func (w *openWait) isCanceled() bool {
+	return atomic.LoadInt32(&w.state) == openCanceled
+}
+
+func (w *openWait) isFailed() bool {
+	return atomic.LoadInt32(&w.state) == openFailed
+}
+
+func (w *openWait) isClosed() bool {
+	return atomic.LoadInt32(&w.state) == openClosed
+}
+
+// isStopped returns true if the net-chan has been canceled, has failed or has been
+// closed.
+func (w *openWait) isStopped() bool {
+	return atomic.LoadInt32(&w.state) >= openCanceled
+}
+
+// error returns why the open was canceled or the net-chan failed, nil otherwise.
+func (w *openWait) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// A waitTable holds the openWait of the last net-chan opened locally with each name,
+// for one direction, so that its error can be retrieved after the net-chan is closed.
+// Net-chans that are closed without errors are removed.
+type waitTable struct {
+	sync.Mutex
+	wait map[string]*openWait
+}
+
+func (t *waitTable) put(chName string, w *openWait) {
+	t.Lock()
+	t.wait[chName] = w
+	t.Unlock()
+}
+
+// closed is called when a net-chan is closed.
+func (t *waitTable) closed(chName string, w *openWait) {
+	t.Lock()
+	if t.wait[chName] == w && w.error() == nil {
+		delete(t.wait, chName)
+	}
+	t.Unlock()
+}
+
+func (t *waitTable) err(chName string) error {
+	t.Lock()
+	w := t.wait[chName]
+	t.Unlock()
+	if w == nil {
+		return nil
+	}
+	return w.error()
+}
+
+// wait waits for the net-chan to become ready. If ctx is done first, the open is
+// canceled and ctx's error is returned.
+func (w *openWait) wait(ctx context.Context, ssn *Session) error {
+	select {
+	case <-w.ready:
+		return nil
+	case <-w.canceled:
+		if w.isClosed() {
+			return errNetChanClosed
+		}
+		return w.err
+	case <-ssn.Done():
+		return ssn.Err()
+	case <-ctx.Done():
+		if w.cancel(ctx.Err()) {
+			<-w.canceled
+			return w.err
+		}
+		if w.isClosed() {
+			return errNetChanClosed
+		}
+		return nil
+	}
+}
+
 // A Session handles the message traffic of its connection, implementing the netchan
 // protocol.
 type Session struct {
@@ -69,6 +234,17 @@ type Session struct {
 
 	errOnce, closeOnce once
 	err, closeErr      error
+	opts               SessionOptions
+	shuttingDown       int32 // set by Shutdown
+	stats              sessionStats
+	quotas             quotas     // resources in use, see quota.go
+	window             connWindow // of the peer, see window.go
+	recvWindow         recvWindow // the local one
+	start              time.Time  // for the stamps of the pings
+	rtt                rttStats
+	hello              chan struct{}     // closed when the hello of the peer is accepted
+	peer               PeerInfo          // from the hello of the peer
+	peerCert           *x509.Certificate // verified TLS certificate of the peer
 }
 
 /*
@@ -114,19 +290,14 @@ Err and keeps draining the channels until they are empty. Then it sends the erro
 the peer and closes the connection.
 */
 
-const (
-	minMsgSizeLimit = 512
-	defMsgSizeLimit = 16 * 1024
-	maxNameLen      = 500
-)
-
 // NewSession starts a new session for the specified connection and returns it. The
 // connection can be any full-duplex io.ReadWriteCloser that provides in-order delivery
 // of data with best-effort reliability. On each end, a connection must have only one
 // session.
 //
 // There is a default limit imposed on the size of incoming gob messages. To change it,
-// use NewSessionLimit.
+// use NewSessionLimit. All the other parameters of the session can be tuned with
+// NewSessionWithOptions.
 //
 // NewSessionLimit is like NewSession, but also allows to specify the maximum size of the gob
 // messages that will be accepted from the connection. If msgSizeLimit is 0 or negative,
@@ -138,51 +309,103 @@ func NewSession(conn io.ReadWriteCloser) *Session {
 
 var newSessionId int64
 
-const internalChCap int = 8
-
 func NewSessionLimit(conn io.ReadWriteCloser, msgSizeLimit int) *Session {
+	return NewSessionCodec(conn, GobCodec{}, msgSizeLimit)
+}
+
+// NewSessionCodec is like NewSessionLimit, but messages are serialized with the
+// specified codec instead of gob. If codec is nil, GobCodec is used. The peer must use a
+// compatible codec.
+func NewSessionCodec(conn io.ReadWriteCloser, codec Codec, msgSizeLimit int) *Session {
 	if msgSizeLimit < minMsgSizeLimit {
 		msgSizeLimit = minMsgSizeLimit
 	}
+	ssn, _ := NewSessionWithOptions(conn,
+		&SessionOptions{MsgSizeLimit: msgSizeLimit, Codec: codec})
+	return ssn
+}
+
+// NewSessionWithOptions is like NewSession, but the behavior of the session is tuned
+// with opts, which can be nil. An error is returned if opts contains invalid values; in
+// that case, no session is started.
+func NewSessionWithOptions(conn io.ReadWriteCloser, opts *SessionOptions) (*Session,
+	error) {
+	var o SessionOptions
+	if opts != nil {
+		o = *opts
+	}
+	err := o.setDefaults()
+	if err != nil {
+		return nil, err
+	}
 
 	// create all the components, connect them with channels and fire up the goroutines.
-	ssn := &Session{id: atomic.AddInt64(&newSessionId, 1), conn: conn}
+	ssn := &Session{id: atomic.AddInt64(&newSessionId, 1), conn: conn, opts: o,
+		start: time.Now(), hello: make(chan struct{})}
+	ssn.recvWindow.notify = make(chan struct{}, 1)
 	ssn.errOnce.done = make(chan struct{})
 	ssn.closeOnce.done = make(chan struct{})
 
-	encDataCh := make(chan data, internalChCap)
-	encCredCh := make(chan credit, internalChCap)
-	decDataCh := make(chan data, internalChCap)
-	decCredCh := make(chan credit, internalChCap)
+	encDataCh := make(chan data, o.InternalChanCap)
+	encCredCh := make(chan credit, o.InternalChanCap)
+	decDataCh := make(chan data, o.InternalChanCap)
+	decCredCh := make(chan credit, o.InternalChanCap)
 
-	enc := newEncoder(ssn, encDataCh, encCredCh, conn)
-	dec := newDecoder(ssn, decDataCh, decCredCh, conn, msgSizeLimit)
+	enc := newEncoder(ssn, encDataCh, encCredCh, conn, o.Codec)
+	dec := newDecoder(ssn, decDataCh, decCredCh, conn, o.MsgSizeLimit, o.Codec)
+	pongCh := make(chan int64, 1)
+	enc.pongCh = pongCh
+	dec.pongCh = pongCh
 
 	recvMn := &recvManager{ssn: ssn, dataCh: decDataCh, toEncoder: encCredCh,
 		types: &dec.types}
 	recvMn.table.buffer = make(map[int]*buffer)
 	recvMn.table.chInfo = make(map[string]rChanInfo)
+	recvMn.table.closing = make(map[string]chan struct{})
+	recvMn.waits.wait = make(map[string]*openWait)
 	ssn.recvMn = recvMn
 	sendMn := &sendManager{ssn: ssn, creditCh: decCredCh, toEncoder: encDataCh}
 	sendMn.table.chans = make(map[int]sChans)
 	sendMn.table.chInfo = make(map[string]sChanInfo)
+	sendMn.table.acks = make(map[int]*ackTracker)
+	sendMn.waits.wait = make(map[string]*openWait)
 	ssn.sendMn = sendMn
 
 	go enc.run()
 	go dec.run()
 	go recvMn.run()
 	go sendMn.run()
+	ssn.watchHandshake()
 
 	netConn, ok := conn.(net.Conn)
 	if ok {
-		logDebug("netchan session %d started on connection (local %s, remote %s)",
-			ssn.id, netConn.LocalAddr(), netConn.RemoteAddr())
+		ssn.logSession(slog.LevelInfo, "session started",
+			slog.String("local_addr", netConn.LocalAddr().String()),
+			slog.String("remote_addr", netConn.RemoteAddr().String()))
 	} else {
-		logDebug("netchan session %d started", ssn.id)
+		ssn.logSession(slog.LevelInfo, "session started")
 	}
 	go func() {
 		<-ssn.Done()
-		logDebug("netchan session %d shut down with error: %s", ssn.id, ssn.Err())
+		level := slog.LevelInfo
+		if ssn.Err() != EndOfSession {
+			level = slog.LevelWarn
+		}
+		ssn.logSession(level, "session shut down", slog.Any("error", ssn.Err()))
+	}()
+	return ssn, nil
+}
+
+// NewSessionContext is like NewSession, but the session is bound to ctx: when ctx is
+// canceled or its deadline expires, the session shuts down with ctx.Err().
+func NewSessionContext(ctx context.Context, conn io.ReadWriteCloser) *Session {
+	ssn := NewSession(conn)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ssn.QuitWith(ctx.Err())
+		case <-ssn.Done():
+		}
 	}()
 	return ssn
 }
@@ -197,7 +420,22 @@ func NewSessionLimit(conn io.ReadWriteCloser, msgSizeLimit int) *Session {
 //
 // Opening a net-chan twice, i.e. with the same name and direction on the same session,
 // will return an error. It is possible to have, on a single session/connection, two
-// net-chans with the same name and opposite directions.
+// net-chans with the same name and opposite directions, but mind the order of the
+// opens: when the open of the peer arrives, if both peers opened the name in the same
+// direction and none of them opened it in the other direction, the net-chan fails on
+// both peers with ErrDirMismatch. So a peer that uses a name in both directions must
+// open the second direction before the open of the peer for the first one arrives, or
+// the peer must open the two directions in the opposite order.
+//
+// Once a net-chan has been closed, by either peer, its name can be reused: net-chans
+// with the same name are paired in the order they are opened. When the channel used for
+// sending is closed, the net-chan is closed as soon as all the values have been sent,
+// which is signaled by NetChan.Done; opening the name for sending before that returns
+// an error. If the previous net-chan with the same name and direction is still being
+// closed (that is, the peer has not acknowledged the close yet), Open waits until the
+// close is complete or the session shuts down. A peer that stops reading from the
+// connection never acknowledges the close, so the wait is not bounded: use
+// OpenSendContext, or set SessionOptions.IdleTimeout, to give up.
 //
 // An eventual error returned by Open does not compromise the netchan session, that is,
 // the error will not be caught by Done and Err methods, will not be
@@ -207,34 +445,129 @@ func NewSessionLimit(conn io.ReadWriteCloser, msgSizeLimit int) *Session {
 // other peer will be closed too. Messages that are already in the buffers or in flight
 // will not be lost.
 func (m *Session) OpenSend(name string, channel interface{}) error {
-	if len(name) > maxNameLen {
-		return fmtErr("OpenSend: name too long")
+	_, err := m.openSend(context.Background(), name, channel)
+	return err
+}
+
+// OpenRecv opens a net-chan for receiving, see OpenSend. Like OpenSend, it waits without
+// a bound while the previous net-chan with the same name is being closed; use
+// OpenRecvContext to give up. The rules on the order of the opens of a name used in both
+// directions are the same as for OpenSend (see ErrDirMismatch).
+func (m *Session) OpenRecv(name string, channel interface{}, bufferCap int) error {
+	_, err := m.openRecv(context.Background(), name, channel, bufferCap, false)
+	return err
+}
+
+// OpenSendContext is like OpenSend, but it also waits for the peer to open the net-chan
+// for receiving. If ctx is done before that happens, ctx.Err() is returned and the
+// net-chan is closed: channel will never be read from and, if the peer opens the
+// net-chan later, it will find it closed. If the session shuts down while waiting, the
+// session error is returned.
+func (m *Session) OpenSendContext(ctx context.Context, name string,
+	channel interface{}) error {
+	nc, err := m.openSend(ctx, name, channel)
+	if err != nil {
+		return err
+	}
+	return nc.wait.wait(ctx, m)
+}
+
+// OpenRecvContext is like OpenRecv, but it also waits for the peer to open the net-chan
+// for sending. If ctx is done before that happens, ctx.Err() is returned and the
+// net-chan is closed: no value will be delivered on channel and the values that the
+// peer may send later are discarded. If the session shuts down while waiting, the
+// session error is returned.
+func (m *Session) OpenRecvContext(ctx context.Context, name string,
+	channel interface{}, bufferCap int) error {
+	nc, err := m.openRecv(ctx, name, channel, bufferCap, false)
+	if err != nil {
+		return err
+	}
+	return nc.wait.wait(ctx, m)
+}
+
+// OpenSendChan is like OpenSend, but it returns a handle to the net-chan, which can be
+// used to check its state and to close it. Like OpenSend, it can block until the
+// previous net-chan with the same name is closed.
+func (m *Session) OpenSendChan(name string, channel interface{}) (*NetChan, error) {
+	return m.openSend(context.Background(), name, channel)
+}
+
+// OpenRecvChan is like OpenRecv, but it returns a handle to the net-chan, which can be
+// used to check its state and to close it. Like OpenRecv, it can block until the
+// previous net-chan with the same name is closed.
+func (m *Session) OpenRecvChan(name string, channel interface{}, bufferCap int) (*NetChan,
+	error) {
+	return m.openRecv(context.Background(), name, channel, bufferCap, false)
+}
+
+func (m *Session) openSend(ctx context.Context, name string, channel interface{}) (*NetChan,
+	error) {
+	if len(name) > m.opts.MaxNameLen {
+		return nil, fmtErr("OpenSend: name too long")
+	}
+	if m.isShuttingDown() {
+		return nil, ErrShuttingDown
 	}
 	ch := reflect.ValueOf(channel)
 	if ch.Kind() != reflect.Chan {
-		return fmtErr("OpenSend: channel arg is not a channel")
+		return nil, fmtErr("OpenSend: channel arg is not a channel")
 	}
 	if ch.Type().ChanDir()&reflect.RecvDir == 0 {
-		return fmtErr("OpenSend requires a <-chan")
+		return nil, fmtErr("OpenSend requires a <-chan")
 	}
-	return m.sendMn.open(name, ch)
+	return m.sendMn.open(ctx, name, ch)
 }
 
-func (m *Session) OpenRecv(name string, channel interface{}, bufferCap int) error {
-	if len(name) > maxNameLen {
-		return fmtErr("OpenRecv: name too long")
+// openRecv opens a net-chan for receiving; if byteCredit is true, bufferCap is in bytes.
+func (m *Session) openRecv(ctx context.Context, name string, channel interface{},
+	bufferCap int, byteCredit bool) (*NetChan, error) {
+	if len(name) > m.opts.MaxNameLen {
+		return nil, fmtErr("OpenRecv: name too long")
+	}
+	if m.isShuttingDown() {
+		return nil, ErrShuttingDown
 	}
 	ch := reflect.ValueOf(channel)
 	if ch.Kind() != reflect.Chan {
-		return fmtErr("OpenRecv channel is not a channel")
+		return nil, fmtErr("OpenRecv channel is not a channel")
 	}
 	if ch.Type().ChanDir()&reflect.SendDir == 0 {
-		return fmtErr("OpenRecv requires a chan<-")
+		return nil, fmtErr("OpenRecv requires a chan<-")
 	}
 	if bufferCap <= 0 {
-		return fmtErr("OpenRecv bufferCap must be at least 1")
+		return nil, fmtErr("OpenRecv bufferCap must be at least 1")
 	}
-	return m.recvMn.open(name, ch, bufferCap)
+	return m.recvMn.open(ctx, name, ch, bufferCap, byteCredit)
+}
+
+// SendErr returns the error that made the net-chan name, opened locally for sending,
+// fail. A net-chan fails when its open is canceled (see ErrDirMismatch and
+// OpenSendContext), when the peer closes it (ErrClosedByPeer) or when the peer resets
+// it because of an error on its side; the other net-chans and the session are not
+// affected. The values sent on a net-chan after it fails are discarded.
+//
+// SendErr returns nil if the net-chan is working, has been closed without errors or has
+// never been opened. The error of the last net-chan opened with that name is kept until
+// the name is reused. Errors that compromise the whole session are reported by Err.
+func (m *Session) SendErr(name string) error {
+	return m.sendMn.waits.err(name)
+}
+
+// RecvErr is like SendErr, for net-chans opened locally for receiving. A receiving
+// net-chan fails if the peer sends more data than its buffer can hold or data that can
+// not be decoded; in that case, the values that have not been delivered yet are
+// discarded, the peer is notified and then the channel passed to OpenRecv is closed.
+func (m *Session) RecvErr(name string) error {
+	return m.recvMn.waits.err(name)
+}
+
+// CloseRecv closes the net-chan name, opened locally for receiving, like NetChan.Close:
+// the peer is told to stop sending, the values in flight are discarded and then the
+// channel passed to OpenRecv is closed. On the peer, the net-chan fails with
+// ErrClosedByPeer.
+func (m *Session) CloseRecv(name string) error {
+	return m.recvMn.close(name)
 }
 
 // Err returns the first error that occurred on this session. If no error
@@ -256,7 +589,8 @@ func (m *Session) Done() <-chan struct{} {
 // Quit tries to send a termination message to the peer and then shuts down the
 // session and closes the connection. The Done channel is closed and Err will
 // return EndOfSession. The remote peer will also shut down and get EndOfSession, if the termination
-// message is received correctly.
+// message is received correctly. Values that are in flight may be lost; see Shutdown for
+// a graceful alternative.
 //
 // The return value is the result of calling Close on the connection. The connection is
 // guaranteed to be closed once and only once, even if Quit is called multiple times,
@@ -284,7 +618,7 @@ func (m *Session) QuitWith(err error) error {
 	// it closes the connection and we wake up and return
 	case <-m.closeOnce.done:
 	// if encoder takes too long, we close the connection ourself
-	case <-time.After(1 * time.Second):
+	case <-time.After(m.opts.QuitTimeout):
 		m.closeConn()
 	}
 	return m.closeErr
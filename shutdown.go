@@ -0,0 +1,53 @@
+package netchan
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+)
+
+// ErrShuttingDown is returned by the open functions after Shutdown has been called.
+var ErrShuttingDown = errors.New("netchan: session is shutting down")
+
+// Shutdown shuts down the session gracefully. Shutdown stops accepting new net-chans
+// (the open functions return ErrShuttingDown) and waits for the net-chans that are
+// open locally to be drained, then it terminates the session like Quit, with
+// EndOfSession, and returns the result of closing the connection.
+//
+// A net-chan open for sending is drained when the user has closed its channel (or the
+// net-chan has been closed in other ways) and the peer has acknowledged the close. The
+// peer acknowledges it after delivering all the values, so none of them is lost. A
+// net-chan open for receiving is drained when the peer has closed it and all its
+// values have been delivered; net-chans that the peer has not opened for sending are
+// not waited for. Both peers can call Shutdown at the same time.
+//
+// If ctx is done before the net-chans are drained, Shutdown returns ctx.Err() and the
+// session keeps running, without accepting new net-chans; call Quit to terminate it.
+// If the session shuts down in the meantime, Shutdown returns its error.
+func (m *Session) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&m.shuttingDown, 1)
+	m.logSession(slog.LevelInfo, "shutting down")
+	// Wait for the busy net-chans one at a time, until none is left.
+	for {
+		freed := m.sendMn.busy()
+		if freed == nil {
+			freed = m.recvMn.busy()
+		}
+		if freed == nil {
+			break
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.Done():
+			return m.Err()
+		}
+	}
+	return m.Quit()
+}
+
+func (m *Session) isShuttingDown() bool {
+	return atomic.LoadInt32(&m.shuttingDown) != 0
+}
@@ -0,0 +1,98 @@
+package netchan
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// BatchLenBuckets is the number of buckets of SessionStats.BatchLens.
+const BatchLenBuckets = 16
+
+// SessionStats is a snapshot of the statistics of a session, see Session.Stats.
+type SessionStats struct {
+	// BytesSent and BytesReceived count the bytes written to and read from the
+	// connection. BytesSent is updated when the connection is flushed.
+	BytesSent, BytesReceived int64
+
+	// MsgsSent and MsgsReceived count the messages of the netchan protocol (data,
+	// credits, open and close messages...).
+	MsgsSent, MsgsReceived int64
+
+	// Flushes counts the flushes of the connection.
+	Flushes int64
+
+	// ItemsSent and ItemsReceived count the values sent and received on all the
+	// net-chans, including the closed ones.
+	ItemsSent, ItemsReceived int64
+
+	// BatchLens is the distribution of the length of the batches sent: BatchLens[i]
+	// counts the batches whose length is between 2^i and 2^(i+1)-1; the last bucket also
+	// counts the longer batches.
+	BatchLens [BatchLenBuckets]int64
+
+	// CreditStalls counts how many times a net-chan opened for sending had to stop
+	// because the peer did not grant enough credit.
+	CreditStalls int64
+
+	// Send and Recv hold the statistics of the net-chans that are currently open
+	// locally, by name.
+	Send, Recv map[string]ChanStats
+
+	// OpenChans is the number of net-chans opened by both peers and not closed yet;
+	// HalfOpenChans is the number of net-chans opened by only one of them.
+	OpenChans, HalfOpenChans int
+}
+
+// Counters of a session, updated atomically by its goroutines.
+type sessionStats struct {
+	bytesSent, bytesRecv int64
+	msgsSent, msgsRecv   int64
+	flushes              int64
+	itemsSent, itemsRecv int64
+	batchLens            [BatchLenBuckets]int64
+	creditStalls         int64
+}
+
+// addBatch counts a batch that has been sent.
+func (s *sessionStats) addBatch(batchLen int) {
+	atomic.AddInt64(&s.itemsSent, int64(batchLen))
+	i := bits.Len(uint(batchLen)) - 1
+	if i >= BatchLenBuckets {
+		i = BatchLenBuckets - 1
+	}
+	atomic.AddInt64(&s.batchLens[i], 1)
+}
+
+// Stats returns a snapshot of the statistics of the session. It is cheap enough to be
+// called periodically, e.g. to feed a monitoring system; the counters are not
+// synchronized with each other, so they may be slightly inconsistent.
+func (m *Session) Stats() SessionStats {
+	s := &m.stats
+	st := SessionStats{
+		BytesSent:     atomic.LoadInt64(&s.bytesSent),
+		BytesReceived: atomic.LoadInt64(&s.bytesRecv),
+		MsgsSent:      atomic.LoadInt64(&s.msgsSent),
+		MsgsReceived:  atomic.LoadInt64(&s.msgsRecv),
+		Flushes:       atomic.LoadInt64(&s.flushes),
+		ItemsSent:     atomic.LoadInt64(&s.itemsSent),
+		ItemsReceived: atomic.LoadInt64(&s.itemsRecv),
+		CreditStalls:  atomic.LoadInt64(&s.creditStalls),
+	}
+	for i := range st.BatchLens {
+		st.BatchLens[i] = atomic.LoadInt64(&s.batchLens[i])
+	}
+	var sendOpen, sendHalf, recvOpen, recvHalf int
+	st.Send, sendOpen, sendHalf = m.sendMn.stats()
+	st.Recv, recvOpen, recvHalf = m.recvMn.stats()
+	st.OpenChans = sendOpen + recvOpen
+	st.HalfOpenChans = sendHalf + recvHalf
+	return st
+}
+
+func (s *chanStats) snapshot() ChanStats {
+	return ChanStats{
+		Items:   atomic.LoadInt64(&s.items),
+		Batches: atomic.LoadInt64(&s.batches),
+		Pending: atomic.LoadInt64(&s.pending),
+	}
+}
@@ -0,0 +1,101 @@
+package netchan
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+/*
+Sessions do not deal with TLS themselves: a *tls.Conn is an io.ReadWriteCloser like any
+other, which performs the TLS handshake with the first read or write. The hello of the
+peer can be read only after that handshake, so handleHello records the certificate that
+the peer presented, if it has been verified, together with the rest of the PeerInfo.
+Only connections that implement ConnectionState, as *tls.Conn does, are inspected.
+*/
+
+// tlsConn is implemented by *tls.Conn.
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// verifiedPeerCert returns the certificate presented by the peer on conn, if conn is a
+// TLS connection and the certificate has been verified.
+func verifiedPeerCert(conn interface{}) *x509.Certificate {
+	tc, ok := conn.(tlsConn)
+	if !ok {
+		return nil
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
+
+// PeerCertificate returns the certificate that the peer presented during the TLS
+// handshake, if the connection of the session is a *tls.Conn and the certificate has
+// been verified against the configured certificate authorities. On the accepting side,
+// that requires tls.Config.ClientAuth to be VerifyClientCertIfGiven or
+// RequireAndVerifyClientCert. PeerCertificate returns nil otherwise, and until the
+// handshake of the session is complete (see Handshake).
+func (m *Session) PeerCertificate() *x509.Certificate {
+	select {
+	case <-m.hello:
+		return m.peerCert
+	default:
+		return nil
+	}
+}
+
+// PeerIdentity returns the common name of the verified certificate of the peer (see
+// PeerCertificate), or "" if there is no such certificate. Unlike PeerInfo.Identity,
+// which the peer declares, it can be used to authorize the peer.
+func (m *Session) PeerIdentity() string {
+	cert := m.PeerCertificate()
+	if cert == nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// DialTLS is like Dial, but the connection is secured with TLS, configured by config.
+// The TLS handshake and the handshake of the session are both complete when DialTLS
+// returns. For mutual authentication, config must contain the certificate of the client
+// and the server must require it (see ListenTLS).
+func DialTLS(ctx context.Context, network, addr string, config *tls.Config,
+	opts *SessionOptions) (*Session, error) {
+	d := tls.Dialer{Config: config}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return startSession(ctx, conn, opts)
+}
+
+// ListenTLS returns a listener on the network address addr that accepts TLS connections,
+// configured by config, which must contain at least one certificate. The listener can be
+// passed to Server.Serve. To authenticate the clients too, set config.ClientAuth to
+// tls.RequireAndVerifyClientCert and config.ClientCAs to the authorities that sign
+// their certificates; then Session.PeerIdentity identifies the client.
+func ListenTLS(network, addr string, config *tls.Config) (net.Listener, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil &&
+		config.GetConfigForClient == nil) {
+		return nil, fmtErr("ListenTLS requires a certificate in config")
+	}
+	return tls.Listen(network, addr, config)
+}
+
+// ListenAndServeTLS is like ListenAndServe, but the connections are secured with TLS,
+// see ListenTLS.
+func (srv *Server) ListenAndServeTLS(network, addr string, config *tls.Config) error {
+	if srv.isClosed() {
+		return ErrServerClosed
+	}
+	l, err := ListenTLS(network, addr, config)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
@@ -0,0 +1,186 @@
+package netchan_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pinkgopher/netchan"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue returns a certificate for name, valid for clients and servers.
+func (ca *testCA) issue(t *testing.T, name string, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// mutualTLS returns the configurations of a server and a client that authenticate each
+// other.
+func mutualTLS(t *testing.T) (server, client *tls.Config) {
+	ca := newTestCA(t)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", 2)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "client", 3)},
+		RootCAs:      ca.pool,
+		ServerName:   "server",
+	}
+	return
+}
+
+// tlsPipeConn is a TLS connection over one side of a net.Pipe. Close closes the pipe
+// directly: as net.Pipe is unbuffered, tls.Conn.Close would wait up to 5 seconds for the
+// peer to read its close_notify alert.
+type tlsPipeConn struct {
+	*tls.Conn
+	raw net.Conn
+}
+
+func (c tlsPipeConn) Close() error {
+	return c.raw.Close()
+}
+
+func TestTLSPipe(t *testing.T) {
+	serverConf, clientConf := mutualTLS(t)
+	sideA, sideB := net.Pipe()
+	mnA := netchan.NewSession(tlsPipeConn{tls.Server(sideA, serverConf), sideA})
+	mnB := netchan.NewSession(tlsPipeConn{tls.Client(sideB, clientConf), sideB})
+	ctx := context.Background()
+	if err := mnA.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnB.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if id := mnA.PeerIdentity(); id != "client" {
+		t.Errorf("the server sees the client as %q", id)
+	}
+	if id := mnB.PeerIdentity(); id != "server" {
+		t.Errorf("the client sees the server as %q", id)
+	}
+	intProducer(t, mnB, "integers", 300)
+	s := <-intConsumer(t, mnA, "integers")
+	if len(s) != 300 {
+		t.Fatalf("expected 300 integers, got %d", len(s))
+	}
+	checkIntSlice(t, s)
+	mnA.Quit()
+	<-mnB.Done()
+
+	// without TLS there is no identity
+	pA, pB := newPipeConn()
+	mnA = netchan.NewSession(pA)
+	mnB = netchan.NewSession(pB)
+	if err := mnA.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mnA.PeerIdentity() != "" || mnA.PeerCertificate() != nil {
+		t.Error("identity without TLS")
+	}
+	mnA.Quit()
+	<-mnB.Done()
+}
+
+func TestDialTLS(t *testing.T) {
+	serverConf, clientConf := mutualTLS(t)
+	ln, err := netchan.ListenTLS("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := make(chan string, 1)
+	srv := netchan.NewServer(func(ssn *netchan.Session) {
+		identities <- ssn.PeerIdentity()
+	}, nil)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ssn, err := netchan.DialTLS(ctx, "tcp", ln.Addr().String(), clientConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := <-identities; id != "client" {
+		t.Errorf("the server sees the client as %q", id)
+	}
+	if id := ssn.PeerIdentity(); id != "server" {
+		t.Errorf("the client sees the server as %q", id)
+	}
+	ssn.Quit()
+
+	// a client without certificate is rejected
+	anonymous := clientConf.Clone()
+	anonymous.Certificates = nil
+	ssn, err = netchan.DialTLS(ctx, "tcp", ln.Addr().String(), anonymous, nil)
+	if err == nil {
+		ssn.Quit()
+		t.Error("a client without certificate has been accepted")
+	}
+
+	if _, err := netchan.ListenTLS("tcp", "127.0.0.1:0", &tls.Config{}); err == nil {
+		t.Error("ListenTLS accepted a configuration without certificates")
+	}
+}
@@ -0,0 +1,159 @@
+package netchan
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Tracer is notified of every protocol message that a session sends or receives, see
+// SessionOptions.Tracer. Trace is called synchronously by the goroutines that encode and
+// decode the messages, so it must be fast and safe for concurrent use.
+type Tracer interface {
+	Trace(ev TraceEvent)
+}
+
+// TraceEvent describes a protocol message.
+type TraceEvent struct {
+	Time    time.Time
+	Session int64 // id of the session, as in the logs
+	Sent    bool  // true if the message has been sent, false if it has been received
+
+	// Type is the type of the message: "hello", "data", "initData", "close", "credit",
+	// "initCredit", "error", "cancel", "closeAck", "reset", "ping", "pong", "ack",
+	// "reject" or "connCredit".
+	Type     string
+	ChId     int
+	ChName   string
+	BatchLen int    // number of values, for data messages
+	Credit   int    // credit, initCredit and connCredit messages
+	Err      string // error, cancel, reset, reject and close messages
+	Seq      uint64 // data and ack messages, if the sender is reliable
+	Size     int    // encoded size in bytes, including the batch
+}
+
+func (ev TraceEvent) String() string {
+	dir := "recv"
+	if ev.Sent {
+		dir = "sent"
+	}
+	s := fmt.Sprintf("%s session %d %s %s chId=%d", ev.Time.Format("15:04:05.000000"),
+		ev.Session, dir, ev.Type, ev.ChId)
+	if ev.ChName != "" {
+		s += fmt.Sprintf(" chName=%q", ev.ChName)
+	}
+	if ev.Type == "data" {
+		s += fmt.Sprintf(" batchLen=%d", ev.BatchLen)
+	}
+	if ev.Seq != 0 {
+		s += fmt.Sprintf(" seq=%d", ev.Seq)
+	}
+	if ev.Credit != 0 {
+		s += fmt.Sprintf(" credit=%d", ev.Credit)
+	}
+	if ev.Err != "" {
+		s += fmt.Sprintf(" err=%q", ev.Err)
+	}
+	return s + fmt.Sprintf(" size=%d", ev.Size)
+}
+
+var msgTypeNames = [...]string{
+	helloMsg:      "hello",
+	dataMsg:       "data",
+	initDataMsg:   "initData",
+	closeMsg:      "close",
+	creditMsg:     "credit",
+	initCreditMsg: "initCredit",
+	errorMsg:      "error",
+	cancelMsg:     "cancel",
+	closeAckMsg:   "closeAck",
+	resetMsg:      "reset",
+	pingMsg:       "ping",
+	pongMsg:       "pong",
+	ackMsg:        "ack",
+	rejectMsg:     "reject",
+	connCreditMsg: "connCredit",
+}
+
+func (t msgType) String() string {
+	if t >= 0 && int(t) < len(msgTypeNames) {
+		return msgTypeNames[t]
+	}
+	return fmt.Sprintf("msgType(%d)", int(t))
+}
+
+// trace notifies the tracer of the session, if any, of a message.
+func (m *Session) trace(sent bool, h *header, batchLen, size int) {
+	if m.opts.Tracer == nil {
+		return
+	}
+	m.opts.Tracer.Trace(TraceEvent{Time: time.Now(), Session: m.id, Sent: sent,
+		Type: h.Type.String(), ChId: h.ChId, ChName: h.ChName, BatchLen: batchLen,
+		Credit: h.Credit, Err: h.Err, Seq: h.Seq, Size: size})
+}
+
+// A TraceRecorder is a Tracer that keeps the last events in a ring buffer. A recorder
+// can be shared by multiple sessions.
+type TraceRecorder struct {
+	mu     sync.Mutex
+	events []TraceEvent
+	next   int // position of the next event in the ring
+	full   bool
+}
+
+// NewTraceRecorder returns a recorder that keeps the last n events.
+func NewTraceRecorder(n int) *TraceRecorder {
+	if n < 1 {
+		n = 1
+	}
+	return &TraceRecorder{events: make([]TraceEvent, n)}
+}
+
+// Trace records ev, implementing Tracer.
+func (r *TraceRecorder) Trace(ev TraceEvent) {
+	r.mu.Lock()
+	r.events[r.next] = ev
+	r.next++
+	if r.next == len(r.events) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// Events returns the recorded events, from the oldest to the newest.
+func (r *TraceRecorder) Events() []TraceEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]TraceEvent(nil), r.events[:r.next]...)
+	}
+	return append(append([]TraceEvent(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// Dump writes the recorded events to w, one per line.
+func (r *TraceRecorder) Dump(w io.Writer) error {
+	for _, ev := range r.Events() {
+		if _, err := fmt.Fprintln(w, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DumpOnError waits for ssn to shut down in a new goroutine. If the session ends with
+// an error other than EndOfSession, the recorded events are written to w, after a line
+// that reports the error.
+func (r *TraceRecorder) DumpOnError(ssn *Session, w io.Writer) {
+	go func() {
+		<-ssn.Done()
+		err := ssn.Err()
+		if err == EndOfSession {
+			return
+		}
+		fmt.Fprintf(w, "netchan session %d ended with error: %s; last protocol events:\n",
+			ssn.id, err)
+		r.Dump(w)
+	}()
+}
@@ -0,0 +1,155 @@
+package netchan
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"sync"
+)
+
+/*
+The messages that open a net-chan (initDataMsg and initCreditMsg) carry a fingerprint of
+the element type used by the peer: its name and, if the session uses gob, a gob
+description of the batch type (the encoding of an empty batch). A peer checks that the
+description can be decoded into its own batch type, which applies gob's compatibility
+rules, as soon as it knows both types: when it opens the net-chan locally, if the peer
+opened it already, or when the opening message of the peer arrives. So mismatched types
+make the open fail with a descriptive error, instead of breaking the decoder in the
+middle of the stream and the whole session with it.
+
+Both peers do the check. The receiver cancels the net-chan, the sender closes it; in
+both cases the user gets the error from the open functions (or from the openWait).
+Batches sent with an unchecked type are discarded by the decoder: the decoder checks the
+fingerprint of the sender under the lock of its typeTable, before decoding any batch.
+*/
+
+// Fingerprint of the type of a net-chan.
+type typeInfo struct {
+	name string // name of the element type
+	desc []byte // gob description of the batch type, nil if not available
+}
+
+// newTypeInfo returns the fingerprint of batchType, a slice type.
+func newTypeInfo(batchType reflect.Type, codec Codec) typeInfo {
+	info := typeInfo{name: batchType.Elem().String()}
+	if _, ok := codec.(GobCodec); !ok {
+		return info
+	}
+	var buf bytes.Buffer
+	// fails for types that gob can't transmit (e.g. channels), no check in that case
+	err := gob.NewEncoder(&buf).EncodeValue(reflect.MakeSlice(batchType, 0, 0))
+	if err == nil {
+		info.desc = buf.Bytes()
+	}
+	return info
+}
+
+// check returns an error if the batches described by info can not be decoded into
+// values of type batchType.
+func (info typeInfo) check(batchType reflect.Type) error {
+	if info.desc == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(info.desc)).DecodeValue(reflect.New(batchType))
+}
+
+func (h *header) setTypeInfo(info typeInfo) {
+	h.ElemType = info.name
+	h.TypeDesc = info.desc
+}
+
+func (h header) typeInfo() typeInfo {
+	return typeInfo{h.ElemType, h.TypeDesc}
+}
+
+// typeMismatch returns the error of a net-chan whose types do not match. detail is the
+// error reported by gob, if any.
+func typeMismatch(chName, sent, received string, detail error) error {
+	if detail == nil {
+		return fmtErr("type mismatch on net-chan %s: values sent as %s, received as %s",
+			chName, sent, received)
+	}
+	return fmtErr("type mismatch on net-chan %s: values sent as %s, received as %s (%s)",
+		chName, sent, received, detail)
+}
+
+// The decoder uses the typeTable to know the type of the batches of each net-chan
+// (batches are decoded before reaching the recvManager).
+type typeTable struct {
+	sync.Mutex
+	batchType map[int]reflect.Type // by id; a nil type means that batches are discarded
+	recvId    map[string]int       // ids of the net-chans open locally, by name
+	remote    map[string]typeInfo  // fingerprints announced by the peer, by name
+}
+
+func (t *typeTable) init() {
+	t.batchType = make(map[int]reflect.Type)
+	t.recvId = make(map[string]int)
+	t.remote = make(map[string]typeInfo)
+}
+
+// addRemote is called by the decoder when the peer announces the type it is going to
+// send. If the net-chan is open locally, the types are checked.
+func (t *typeTable) addRemote(chName string, info typeInfo) error {
+	t.Lock()
+	defer t.Unlock()
+	t.remote[chName] = info
+	id, open := t.recvId[chName]
+	batchType := t.batchType[id]
+	if !open || batchType == nil {
+		return nil
+	}
+	err := info.check(batchType)
+	if err != nil {
+		t.batchType[id] = nil
+		return typeMismatch(chName, info.name, batchType.Elem().String(), err)
+	}
+	return nil
+}
+
+// addLocal is called when a net-chan is opened locally for receiving. If the peer
+// already announced its type, the types are checked. The net-chan is added to the table
+// anyway, but its batches are discarded if the types do not match.
+func (t *typeTable) addLocal(chName string, id int, batchType reflect.Type) error {
+	t.Lock()
+	defer t.Unlock()
+	t.recvId[chName] = id
+	t.batchType[id] = batchType
+	info, present := t.remote[chName]
+	if !present {
+		return nil
+	}
+	err := info.check(batchType)
+	if err != nil {
+		t.batchType[id] = nil
+		return typeMismatch(chName, info.name, batchType.Elem().String(), err)
+	}
+	return nil
+}
+
+// remove is called when a net-chan is closed.
+func (t *typeTable) remove(chName string, id int) {
+	t.Lock()
+	defer t.Unlock()
+	if id != 0 && t.recvId[chName] == id {
+		delete(t.recvId, chName)
+		delete(t.batchType, id)
+	}
+	delete(t.remote, chName)
+}
+
+// discard is called when a net-chan fails: its batches will be discarded.
+func (t *typeTable) discard(id int) {
+	t.Lock()
+	defer t.Unlock()
+	if _, present := t.batchType[id]; present {
+		t.batchType[id] = nil
+	}
+}
+
+func (t *typeTable) get(id int) (batchType reflect.Type, present bool) {
+	t.Lock()
+	defer t.Unlock()
+	batchType, present = t.batchType[id]
+	return
+}
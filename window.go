@@ -0,0 +1,274 @@
+package netchan
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Besides the credits of each net-chan, a session can limit the values that the peer sends
+on all the net-chans together, like the connection window of HTTP/2. The receiver
+announces its window (SessionOptions.ConnWindow) in the hello message. Then:
+
+- the sender numbers the values of each batch in the header of the data message
+  (BatchLen). The decoder charges them to the window, before anything else, and the
+  session fails if the window is exceeded;
+
+- when a batch leaves the buffer of its net-chan, or is discarded, its values are added
+  to recvWindow.due and the encoder is notified, without blocking, as for the pongs. The
+  encoder sends the due credits in a connCreditMsg: the credits of many batches are
+  often sent with a single message;
+
+- on the sender, the decoder passes the connection credits to the connWindow, which the
+  sendProxies share. When a sendProxy has a value to send, it asks the connWindow for
+  credits for the whole batch; if there are none, it waits in a queue, still receiving
+  the credits of its net-chan. The credits are granted in the order of the requests. The
+  credits that a sendProxy does not use are given back.
+
+The receiver gives back the connection credits of a batch when it gives back the
+credits of its net-chan, so each sendProxy knows how much of the window it holds: the
+values of the batches whose credits have not come back (with byte credits, each credit
+message covers one batch, in order). A sendProxy never holds more than an equal share of
+the window among the net-chans open for sending; when it holds its share, it waits for
+the credits of its net-chan before asking for more. So the busy net-chans can not starve
+the others, even if nobody receives from them.
+*/
+
+// A connWindow holds the credits of the connection window of the peer.
+type connWindow struct {
+	mu      sync.Mutex
+	size    int // 0 if the peer has no window
+	avail   int
+	senders int // sendProxies running, which share the window
+	waiters []*windowWaiter
+}
+
+// A windowWaiter is a sendProxy waiting for credits.
+type windowWaiter struct {
+	want    int
+	granted chan int // receives the credits granted; it has capacity 1
+}
+
+// setSize is called when the hello of the peer arrives, before any credit is requested.
+func (w *connWindow) setSize(size int) {
+	w.mu.Lock()
+	w.size, w.avail = size, size
+	w.mu.Unlock()
+}
+
+// limited returns true if the peer has a window.
+func (w *connWindow) limited() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size > 0
+}
+
+// join and leave count the sendProxies that share the window.
+func (w *connWindow) join() {
+	w.mu.Lock()
+	w.senders++
+	w.mu.Unlock()
+}
+
+func (w *connWindow) leave() {
+	w.mu.Lock()
+	w.senders--
+	w.mu.Unlock()
+}
+
+// share returns the largest part of the window that a sendProxy can hold, with n
+// sendProxies waiting. It is called with the mutex locked.
+func (w *connWindow) share(n int) int {
+	n = max(n, w.senders, 1)
+	if s := w.size / n; s > 1 {
+		return s
+	}
+	return 1
+}
+
+// acquire requests up to want credits, with want > 0, for a sendProxy that holds held
+// credits already. It returns the credits granted right away or, if none is available,
+// a waiter that will receive them. It returns 0 and no waiter if the sendProxy holds its
+// share of the window already.
+func (w *connWindow) acquire(want, held int) (int, *windowWaiter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size == 0 {
+		return want, nil
+	}
+	want = min(want, w.share(len(w.waiters)+1)-held)
+	if want <= 0 {
+		return 0, nil
+	}
+	if len(w.waiters) == 0 && w.avail > 0 {
+		n := min(want, w.avail)
+		w.avail -= n
+		return n, nil
+	}
+	ww := &windowWaiter{want: want, granted: make(chan int, 1)}
+	w.waiters = append(w.waiters, ww)
+	return 0, ww
+}
+
+// serve grants the available credits to the waiters, in order. It is called with the
+// mutex locked.
+func (w *connWindow) serve() {
+	for len(w.waiters) > 0 && w.avail > 0 {
+		ww := w.waiters[0]
+		n := min(ww.want, w.avail, w.share(len(w.waiters)))
+		w.avail -= n
+		ww.granted <- n
+		w.waiters[0] = nil
+		w.waiters = w.waiters[1:]
+	}
+}
+
+// add adds the credits sent by the peer. It returns an error if the peer grants more
+// than its window.
+func (w *connWindow) add(n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.avail += n
+	if w.avail > w.size {
+		return fmtErr("peer granted more connection credit than its window")
+	}
+	w.serve()
+	return nil
+}
+
+// release gives back the credits that a sendProxy did not use.
+func (w *connWindow) release(n int) {
+	if n <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size == 0 {
+		return
+	}
+	w.avail += n
+	w.serve()
+}
+
+// cancel removes a waiter from the queue. If credits have been granted to it already,
+// they are given back.
+func (w *connWindow) cancel(ww *windowWaiter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, x := range w.waiters {
+		if x == ww {
+			w.waiters = append(w.waiters[:i], w.waiters[i+1:]...)
+			return
+		}
+	}
+	select {
+	case n := <-ww.granted:
+		w.avail += n
+		w.serve()
+	default:
+	}
+}
+
+// acquireWindow waits for up to want credits of the connection window of the peer,
+// while receiving the credits of the net-chan. It returns 0 if the net-chan stops or
+// the session is done first.
+func (s *sendProxy) acquireWindow(want int) int {
+	for {
+		n, ww := s.ssn.window.acquire(want, s.windowHeld)
+		if n > 0 {
+			return n
+		}
+		if ww != nil {
+			return s.waitWindow(ww)
+		}
+		// the net-chan holds its share of the window
+		select {
+		case c := <-s.creditCh:
+			s.recvCredit(c)
+			if s.canceled {
+				return 0
+			}
+		case <-s.wait.canceled:
+			return 0
+		case <-s.ssn.Done():
+			return 0
+		}
+	}
+}
+
+// waitWindow waits for the credits granted to ww.
+func (s *sendProxy) waitWindow(ww *windowWaiter) int {
+	for {
+		select {
+		case n := <-ww.granted:
+			return n
+		case c := <-s.creditCh:
+			s.recvCredit(c)
+			if !s.canceled {
+				continue
+			}
+		case <-s.wait.canceled:
+		case <-s.ssn.Done():
+			return 0
+		}
+		s.ssn.window.cancel(ww)
+		return 0
+	}
+}
+
+// holdWindow records the values of a batch sent, which hold the window until the
+// credits of the batch come back.
+func (s *sendProxy) holdWindow(batchLen int) {
+	s.windowHeld += batchLen
+	if s.byteCredit {
+		s.windowBatches = append(s.windowBatches, batchLen)
+	}
+}
+
+// releaseWindow is called when the credits of a batch come back: amount values, or
+// bytes with byte credits.
+func (s *sendProxy) releaseWindow(amount int) {
+	if !s.byteCredit {
+		s.windowHeld -= amount
+		return
+	}
+	if len(s.windowBatches) > 0 {
+		s.windowHeld -= s.windowBatches[0]
+		s.windowBatches = s.windowBatches[1:]
+	}
+}
+
+// recvWindow tracks the connection window of the local session.
+type recvWindow struct {
+	pending int64         // values charged and not given back yet
+	due     int64         // values given back, to be sent to the peer
+	notify  chan struct{} // wakes up the encoder; it has capacity 1
+}
+
+// chargeWindow charges the values of a batch received to the window. It is called by
+// the decoder and returns an error if the peer exceeded the window.
+func (m *Session) chargeWindow(batchLen int) error {
+	if m.opts.ConnWindow == 0 {
+		return nil
+	}
+	if batchLen < 0 ||
+		atomic.AddInt64(&m.recvWindow.pending, int64(batchLen)) > int64(m.opts.ConnWindow) {
+		return fmtErr("peer exceeded the connection window")
+	}
+	return nil
+}
+
+// returnWindow gives back the credits of batchLen values, which have left the buffer of
+// their net-chan or have been discarded. When a batch leaves the buffer, it is called
+// together with the credit message of the net-chan, see above.
+func (m *Session) returnWindow(batchLen int) {
+	if m.opts.ConnWindow == 0 || batchLen == 0 {
+		return
+	}
+	atomic.AddInt64(&m.recvWindow.pending, -int64(batchLen))
+	atomic.AddInt64(&m.recvWindow.due, int64(batchLen))
+	select {
+	case m.recvWindow.notify <- struct{}{}:
+	default: // the encoder has been notified already
+	}
+}